@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+// archiveDocuments is the name of the file of the documents of each index in
+// the archive, before the extension of the compression.
+const archiveDocuments = "documents.jsonl"
+
+// archiveSkippedSettings are the index settings that are set by the server
+// when the index is created, and cannot be set to recreate it.
+var archiveSkippedSettings = []string{
+	"uuid",
+	"creation_date",
+	"provided_name",
+	"version",
+	"resize",
+	"routing.allocation.initial_recovery",
+	"history.uuid",
+}
+
+// archiveIndex is what is needed to recreate an index, as returned by the
+// server: its mappings, settings and aliases, each in the format of the body
+// of the create index API.
+type archiveIndex struct {
+	mappings json.RawMessage
+	settings json.RawMessage
+	aliases  json.RawMessage
+}
+
+type archiveManifest struct {
+	Created      time.Time              `json:"created"`
+	Distribution string                 `json:"distribution"`
+	Version      string                 `json:"version"`
+	Target       string                 `json:"target"`
+	Query        obj                    `json:"query"`
+	Compression  string                 `json:"compression,omitempty"`
+	Documents    uint64                 `json:"documents"`
+	Indices      []archiveManifestIndex `json:"indices"`
+}
+
+type archiveManifestIndex struct {
+	Name      string   `json:"name"`
+	Documents uint64   `json:"documents"`
+	Files     []string `json:"files"`
+}
+
+// initArchive sets the documents to be written to a file per index, in a
+// temporary directory next to the archive, from which they are copied into the
+// archive once the dump is complete, as the size of each file must be known
+// before it is added. An archive uploaded to S3 is staged in the temporary
+// directory of the system.
+func (d *dumper) initArchive() {
+	dir := os.TempDir()
+	if !isS3Path(d.archive) {
+		dir = filepath.Dir(d.archive)
+	}
+	tmp, err := os.MkdirTemp(dir, ".esdump-archive-")
+	if err != nil {
+		log.Fatal("creating temporary directory of the archive", "err", err)
+	}
+	if isS3Path(d.archive) {
+		log.Info("staging the documents of the archive before the upload", "dir", tmp)
+	}
+	d.archiveDir = tmp
+	d.outputTemplate = filepath.Join(tmp, "{index}", archiveDocuments)
+}
+
+// getArchiveIndices gets the mappings, settings and aliases of the indices of
+// the target.
+func (d *dumper) getArchiveIndices(ctx context.Context) {
+	var mappings, settings, aliases map[string]json.RawMessage
+	d.getIndices(ctx, "_mapping", &mappings)
+	d.getIndices(ctx, "_settings", &settings)
+	d.getIndices(ctx, "_alias", &aliases)
+
+	d.archiveIndices = make(map[string]*archiveIndex, len(settings))
+	for index, raw := range settings {
+		filtered, err := filterSettings(raw)
+		if err != nil {
+			log.Fatal("parsing index settings", "index", index, "err", err)
+		}
+		d.archiveIndices[index] = &archiveIndex{
+			mappings: mappings[index],
+			settings: filtered,
+			aliases:  aliases[index],
+		}
+	}
+}
+
+// filterSettings removes the settings that cannot be set on a new index.
+func filterSettings(raw json.RawMessage) (json.RawMessage, error) {
+	var settings struct {
+		Settings struct {
+			Index obj `json:"index"`
+		} `json:"settings"`
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, err
+	}
+	for _, path := range archiveSkippedSettings {
+		deleteSetting(settings.Settings.Index, strings.Split(path, "."))
+	}
+	return json.Marshal(settings)
+}
+
+// deleteSetting deletes a nested setting, and the objects it leaves empty.
+func deleteSetting(settings obj, path []string) {
+	if len(path) == 1 {
+		delete(settings, path[0])
+		return
+	}
+	sub, ok := settings[path[0]].(map[string]any)
+	if !ok {
+		return
+	}
+	deleteSetting(sub, path[1:])
+	if len(sub) == 0 {
+		delete(settings, path[0])
+	}
+}
+
+// writeArchive writes the archive: the manifest, and then the mappings,
+// settings, aliases and documents of each index, in a directory named after
+// the index.
+func (d *dumper) writeArchive() (err error) {
+	f, err := d.createOutputFile(d.archive)
+	if err != nil {
+		return fmt.Errorf("creating archive: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && !isS3Path(d.archive) {
+			os.Remove(d.archive)
+		}
+	}()
+	out := bufio.NewWriter(f)
+	tw := tar.NewWriter(out)
+
+	manifest := archiveManifest{
+		Created:      d.start.UTC(),
+		Distribution: d.server.distribution,
+		Version:      d.server.version,
+		Target:       d.target,
+		Query:        d.query,
+		Compression:  d.compress,
+	}
+	indices := make([]string, 0, len(d.archiveIndices))
+	for index := range d.archiveIndices {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	for _, index := range indices {
+		mi := archiveManifestIndex{
+			Name:  index,
+			Files: []string{"mappings.json", "settings.json", "aliases.json"},
+		}
+		if tf, ok := d.tmpl.files[index]; ok {
+			mi.Documents = tf.docs
+			mi.Files = append(mi.Files, filepath.Base(tf.path))
+		}
+		manifest.Documents += mi.Documents
+		manifest.Indices = append(manifest.Indices, mi)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := d.writeArchiveFile(tw, "manifest.json", append(b, '\n')); err != nil {
+		return err
+	}
+	for i, index := range indices {
+		ai := d.archiveIndices[index]
+		for j, content := range []json.RawMessage{ai.mappings, ai.settings, ai.aliases} {
+			name := manifest.Indices[i].Files[j]
+			if len(content) == 0 {
+				content = json.RawMessage("{}")
+			}
+			if err := d.writeArchiveFile(tw, index+"/"+name, append(content, '\n')); err != nil {
+				return err
+			}
+		}
+		if tf, ok := d.tmpl.files[index]; ok {
+			if err := d.copyArchiveFile(tw, index+"/"+filepath.Base(tf.path), tf.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	log.Info("archive written", "file", d.archive, "indices", len(indices), "documents", manifest.Documents)
+	return nil
+}
+
+func (d *dumper) writeArchiveFile(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(content)),
+		ModTime: d.start,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	return nil
+}
+
+func (d *dumper) copyArchiveFile(tw *tar.Writer, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    st.Size(),
+		ModTime: d.start,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+const (
+	bulkActionIndex  = "index"
+	bulkActionCreate = "create"
+)
+
+// bulkHit is the metadata of a hit needed to re-import it.
+type bulkHit struct {
+	Index   string          `json:"_index"`
+	Type    string          `json:"_type"`
+	ID      string          `json:"_id"`
+	Routing string          `json:"_routing"`
+	Source  json.RawMessage `json:"_source"`
+}
+
+type bulkActionMeta struct {
+	Index   string `json:"_index"`
+	Type    string `json:"_type,omitempty"`
+	ID      string `json:"_id,omitempty"`
+	Routing string `json:"routing,omitempty"`
+}
+
+// bulkEncoder writes each hit as an action line followed by its _source, as
+// expected by the _bulk API. The output is optionally split into chunks that
+// can each be sent in a single request.
+type bulkEncoder struct {
+	w         *bufio.Writer
+	action    string
+	index     string
+	chunkSize int64
+	// opens the next chunk when the current one is full
+	next func() (*bufio.Writer, error)
+
+	written int64
+	buf     []byte
+	line    lineCompactor
+}
+
+func (d *dumper) newBulkEncoder(w *bufio.Writer) *bulkEncoder {
+	return &bulkEncoder{
+		w:         w,
+		action:    d.bulkAction,
+		index:     d.bulkIndex,
+		chunkSize: int64(d.bulkChunkSize),
+		next:      d.nextChunk,
+	}
+}
+
+func (e *bulkEncoder) encode(h hit) error {
+	var bh bulkHit
+	if err := json.Unmarshal(h.doc, &bh); err != nil {
+		return fmt.Errorf("parsing hit: %w", err)
+	}
+	if len(bh.Source) == 0 {
+		return fmt.Errorf("hit %s/%s has no _source, it cannot be re-imported", bh.Index, bh.ID)
+	}
+
+	meta := bulkActionMeta{
+		Index:   bh.Index,
+		ID:      bh.ID,
+		Routing: bh.Routing,
+	}
+	if e.index != "" {
+		meta.Index = strings.ReplaceAll(e.index, "{index}", bh.Index)
+	}
+	// the types other than the default one only exist before Elasticsearch 7,
+	// and must then be set to index the documents
+	if bh.Type != "_doc" {
+		meta.Type = bh.Type
+	}
+	action, err := json.Marshal(map[string]bulkActionMeta{e.action: meta})
+	if err != nil {
+		return err
+	}
+	source, err := e.line.compact(bh.Source)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(action) + len(source) + 2)
+	if e.chunkSize > 0 && e.written > 0 && e.written+size > e.chunkSize {
+		if e.w, err = e.next(); err != nil {
+			return err
+		}
+		e.written = 0
+	}
+	if e.chunkSize > 0 && size > e.chunkSize {
+		log.Warn("document larger than the bulk chunk size, it is written alone in its chunk",
+			"index", bh.Index, "id", bh.ID, "size", size)
+	}
+	e.written += size
+
+	e.buf = append(e.buf[:0], action...)
+	e.buf = append(e.buf, '\n')
+	e.buf = append(e.buf, source...)
+	e.buf = append(e.buf, '\n')
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+func (e *bulkEncoder) flush() error {
+	return nil
+}
+
+func (e *bulkEncoder) close() error {
+	return nil
+}
+
+// chunkPath returns the path of the nth chunk of the output, numbered before
+// the extension and the compression extension, e.g. dump-00001.ndjson.gz.
+func chunkPath(path string, n int) string {
+	var zext string
+	for _, ext := range compressExtensions {
+		if strings.HasSuffix(path, ext) {
+			zext = ext
+			path = strings.TrimSuffix(path, ext)
+			break
+		}
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%05d%s%s", strings.TrimSuffix(path, ext), n, ext, zext)
+}
+
+// nextChunk closes the current chunk of the output and opens the next one.
+func (d *dumper) nextChunk() (*bufio.Writer, error) {
+	if err := d.out.Flush(); err != nil {
+		return nil, err
+	}
+	if d.zw != nil {
+		if err := d.zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.outFile.Close(); err != nil {
+		return nil, err
+	}
+	d.chunks++
+	path := d.compressedPath(chunkPath(d.output, d.chunks))
+	f, err := d.createOutputFile(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("writing the next chunk", "file", path)
+	d.setOutputFile(f, 0)
+	return d.out, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestChunkPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "dump.ndjson", want: "dump-00002.ndjson"},
+		{path: "dump.ndjson.gz", want: "dump-00002.ndjson.gz"},
+		{path: "dump.ndjson.zst", want: "dump-00002.ndjson.zst"},
+		{path: "out/dump", want: "out/dump-00002"},
+		{path: "dump.gz", want: "dump-00002.gz"},
+	}
+	for _, tt := range tests {
+		if got := chunkPath(tt.path, 2); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	bulkOpIndex  = "index"
+	bulkOpCreate = "create"
+	bulkOpUpdate = "update"
+)
+
+// bulkDoc is a document to index with the _bulk API.
+type bulkDoc struct {
+	index   string
+	typ     string
+	id      string
+	routing string
+	source  json.RawMessage
+}
+
+// bulkItem is a document of a batch, as the action and source lines of the
+// _bulk request.
+type bulkItem struct {
+	index string
+	lines []byte
+}
+
+type bulkResp struct {
+	Errors bool                      `json:"errors"`
+	Items  []map[string]bulkItemResp `json:"items"`
+}
+
+type bulkItemResp struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkIndexer indexes documents in batches, sent concurrently to the _bulk
+// API. The documents rejected by the server are retried if the rejection is
+// transient (e.g. a full queue), and logged otherwise, without stopping the
+// indexing.
+type bulkIndexer struct {
+	// the dumper that holds the throttling and retry settings
+	d          *dumper
+	cl         *httpClient
+	op         string
+	withTypes  bool
+	batchDocs  int
+	batchBytes int64
+	workers    int
+
+	batch    []bulkItem
+	size     int64
+	batches  chan []bulkItem
+	indexed  uint64
+	existing uint64
+	failed   uint64
+	// duration of the last successful request, in ns
+	lastDelay int64
+}
+
+func (d *dumper) newBulkIndexer(cl *httpClient, server serverInfo, op string, batchDocs int, batchBytes int64, workers int) *bulkIndexer {
+	return &bulkIndexer{
+		d:  d,
+		cl: cl,
+		op: op,
+		// mapping types were removed in Elasticsearch 7
+		withTypes:  !server.isOpenSearch() && server.major < 7,
+		batchDocs:  batchDocs,
+		batchBytes: batchBytes,
+		workers:    workers,
+		batches:    make(chan []bulkItem, workers),
+	}
+}
+
+// add adds a document to the current batch, which is sent once full.
+func (e *bulkIndexer) add(ctx context.Context, doc bulkDoc) error {
+	item, err := e.item(doc)
+	if err != nil {
+		log.Error("document rejected", "index", doc.index, "id", doc.id, "err", err)
+		atomic.AddUint64(&e.failed, 1)
+		return nil
+	}
+	if len(e.batch) > 0 && e.batchBytes > 0 && e.size+int64(len(item.lines)) > e.batchBytes {
+		if err := e.flush(ctx); err != nil {
+			return err
+		}
+	}
+	e.batch = append(e.batch, item)
+	e.size += int64(len(item.lines))
+	if len(e.batch) >= e.batchDocs {
+		return e.flush(ctx)
+	}
+	return nil
+}
+
+func (e *bulkIndexer) item(doc bulkDoc) (bulkItem, error) {
+	meta := bulkActionMeta{
+		Index:   doc.index,
+		ID:      doc.id,
+		Routing: doc.routing,
+	}
+	if e.withTypes {
+		meta.Type = doc.typ
+		if meta.Type == "" {
+			meta.Type = "_doc"
+		}
+	}
+	if e.op == bulkOpUpdate && doc.id == "" {
+		return bulkItem{}, fmt.Errorf("document has no _id, it cannot be updated")
+	}
+	action, err := json.Marshal(map[string]bulkActionMeta{e.op: meta})
+	if err != nil {
+		return bulkItem{}, err
+	}
+
+	lines := make([]byte, 0, len(action)+len(doc.source)+32)
+	lines = append(lines, action...)
+	lines = append(lines, '\n')
+	if e.op == bulkOpUpdate {
+		lines = append(lines, `{"doc":`...)
+		lines = append(lines, doc.source...)
+		lines = append(lines, `,"doc_as_upsert":true}`...)
+	} else {
+		lines = append(lines, doc.source...)
+	}
+	lines = append(lines, '\n')
+	return bulkItem{index: doc.index, lines: lines}, nil
+}
+
+// flush sends the current batch to the workers.
+func (e *bulkIndexer) flush(ctx context.Context) error {
+	if len(e.batch) == 0 {
+		return nil
+	}
+	select {
+	case e.batches <- e.batch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	e.batch = nil
+	e.size = 0
+	return nil
+}
+
+// close sends the last batch, after which no document can be added.
+func (e *bulkIndexer) close(ctx context.Context) error {
+	defer close(e.batches)
+	return e.flush(ctx)
+}
+
+// run sends the batches until the indexer is closed.
+func (e *bulkIndexer) run(ctx context.Context) error {
+	workers, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < e.workers; i++ {
+		workers.Go(func() error {
+			for batch := range e.batches {
+				if err := e.send(ctx, batch); err != nil {
+					// let the producer stop on the canceled context
+					go func() {
+						for range e.batches {
+						}
+					}()
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return workers.Wait()
+}
+
+// send sends a batch, and then the documents rejected for transient reasons
+// again, with the same backoff as the failed requests.
+func (e *bulkIndexer) send(ctx context.Context, batch []bulkItem) error {
+	var body strings.Builder
+	for attempt := 0; ; attempt++ {
+		body.Reset()
+		for _, item := range batch {
+			body.Write(item.lines)
+		}
+
+		start := time.Now()
+		var resp bulkResp
+		status, raw, err := e.cl.Post(ctx, "_bulk", body.String(), &resp)
+		took := time.Since(start)
+		if err == nil && status == http.StatusOK {
+			atomic.StoreInt64(&e.lastDelay, int64(took))
+			batch = e.handleResp(batch, resp, attempt >= e.d.retries)
+			cancelableSleep(ctx, e.d.throttlingDuration(took))
+			if len(batch) == 0 {
+				return nil
+			}
+		} else {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			retryable := isRetryableStatus(status)
+			reason := fmt.Sprintf("status code %d", status)
+			if err != nil {
+				retryable = isRetryableError(err)
+				reason = err.Error()
+			}
+			if !retryable || attempt >= e.d.retries {
+				if err != nil {
+					return fmt.Errorf("sending bulk request: %w", err)
+				}
+				if status == http.StatusRequestEntityTooLarge {
+					return fmt.Errorf("bulk request too large, lower the batch size: %w", newStatusError(status, raw))
+				}
+				log.Error("got unexpected status code", "code", status, "response", string(raw))
+				return newStatusError(status, raw)
+			}
+			log.Warn("bulk request failed, retrying", "reason", reason,
+				"attempt", fmt.Sprintf("%d/%d", attempt+1, e.d.retries))
+		}
+
+		atomic.AddUint64(&e.d.retried, 1)
+		cancelableSleep(ctx, e.d.retryBackoff(attempt))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// delay returns how long the server took to handle the last successful
+// request, as a measure of its load. The backoffs of the retries are left out,
+// as they already hold back the batches until the retries are done.
+func (e *bulkIndexer) delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.lastDelay))
+}
+
+// handleResp counts the results of the items of the batch, and returns the
+// items to retry.
+func (e *bulkIndexer) handleResp(batch []bulkItem, resp bulkResp, last bool) []bulkItem {
+	if len(resp.Items) < len(batch) {
+		// the items without a result cannot be known to be indexed
+		for _, item := range batch[len(resp.Items):] {
+			action, _, _ := bytes.Cut(item.lines, []byte("\n"))
+			log.Error("document missing from the bulk response", "index", item.index, "action", string(action))
+		}
+		atomic.AddUint64(&e.failed, uint64(len(batch)-len(resp.Items)))
+		batch = batch[:len(resp.Items)]
+	}
+	if !resp.Errors {
+		atomic.AddUint64(&e.indexed, uint64(len(batch)))
+		return nil
+	}
+	var retry []bulkItem
+	for i, item := range batch {
+		// each item has a single key, the action
+		for _, r := range resp.Items[i] {
+			switch {
+			case r.Status < 300:
+				atomic.AddUint64(&e.indexed, 1)
+			case r.Status == http.StatusConflict && e.op == bulkOpCreate:
+				// the document exists already, which is what create is for
+				atomic.AddUint64(&e.existing, 1)
+			case isRetryableStatus(r.Status) && !last:
+				retry = append(retry, item)
+			default:
+				atomic.AddUint64(&e.failed, 1)
+				log.Error("document rejected", "index", item.index, "id", r.ID, "status", r.Status,
+					"reason", r.Error.Type+": "+r.Error.Reason)
+			}
+		}
+	}
+	if len(retry) > 0 {
+		log.Warn("documents rejected, retrying", "docs", len(retry))
+	}
+	return retry
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestHandleRespMissingItems(t *testing.T) {
+	batch := []bulkItem{
+		{index: "a", lines: []byte(`{"index":{"_id":"1"}}` + "\n{}\n")},
+		{index: "a", lines: []byte(`{"index":{"_id":"2"}}` + "\n{}\n")},
+		{index: "a", lines: []byte(`{"index":{"_id":"3"}}` + "\n{}\n")},
+	}
+	ok := map[string]bulkItemResp{"index": {ID: "1", Status: 201}}
+	rejected := map[string]bulkItemResp{"index": {ID: "2", Status: 429}}
+
+	e := &bulkIndexer{op: bulkOpIndex}
+	retry := e.handleResp(batch, bulkResp{Items: []map[string]bulkItemResp{ok}}, false)
+	if len(retry) != 0 || e.indexed != 1 || e.failed != 2 {
+		t.Errorf("without errors: got %d to retry, %d indexed and %d failed, want 0, 1 and 2", len(retry), e.indexed, e.failed)
+	}
+
+	e = &bulkIndexer{op: bulkOpIndex}
+	retry = e.handleResp(batch, bulkResp{Errors: true, Items: []map[string]bulkItemResp{ok, rejected}}, false)
+	if len(retry) != 1 || e.indexed != 1 || e.failed != 1 {
+		t.Errorf("with errors: got %d to retry, %d indexed and %d failed, want 1, 1 and 1", len(retry), e.indexed, e.failed)
+	}
+}
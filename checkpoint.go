@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+const checkpointInterval = 10 * time.Second
+
+// checkpoint records the progress of a dump so that it can be resumed after a
+// failure. It is only updated by the writer, with what has actually been
+// flushed to the output, so that resuming never leaves gaps nor duplicates.
+type checkpoint struct {
+	Target           string                      `json:"target"`
+	Query            string                      `json:"query"`
+	PitID            string                      `json:"pit_id"`
+	SliceCount       int                         `json:"slice_count"`
+	Slices           map[string]*sliceCheckpoint `json:"slices"`
+	Indices          map[string]uint64           `json:"indices"`
+	Dumped           uint64                      `json:"dumped"`
+	OutputOffset     int64                       `json:"output_offset"`
+	OutputPart       int                         `json:"output_part,omitempty"`
+	PartDocs         uint64                      `json:"part_docs,omitempty"`
+	DeadLetterOffset int64                       `json:"dead_letter_offset,omitempty"`
+	Complete         bool                        `json:"complete"`
+
+	path     string
+	lastSave time.Time
+}
+
+type sliceCheckpoint struct {
+	SearchAfter json.RawMessage `json:"search_after,omitempty"`
+	Written     uint64          `json:"written"`
+	Done        bool            `json:"done"`
+}
+
+// loadCheckpoint reads the checkpoint file, or returns nil if it doesn't exist.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint: %w", err)
+	}
+	if c.Slices == nil {
+		c.Slices = make(map[string]*sliceCheckpoint)
+	}
+	if c.Indices == nil {
+		c.Indices = make(map[string]uint64)
+	}
+	return &c, nil
+}
+
+// save atomically replaces the checkpoint file, so that a crash while saving
+// leaves the previous checkpoint intact.
+func (c *checkpoint) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return err
+	}
+	c.lastSave = time.Now()
+	return nil
+}
+
+// writeFileAtomic replaces the file with a temporary file, so that a crash
+// while writing leaves the previous file intact.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// record updates the progress of the slice of the page, of which the first
+// `written` hits have been written.
+func (c *checkpoint) record(p page, written int) {
+	sc, ok := c.Slices[p.slice]
+	if !ok {
+		sc = &sliceCheckpoint{}
+		c.Slices[p.slice] = sc
+	}
+	sc.Written += uint64(written)
+	for _, h := range p.hits[:written] {
+		c.Indices[h.index]++
+	}
+	// if the page has only been partially written, the count limit has been
+	// reached and the dump is over, there is nothing to resume
+	if written == len(p.hits) {
+		if p.searchAfter != nil {
+			sc.SearchAfter = p.searchAfter
+		}
+		sc.Done = p.done
+	}
+}
+
+func (c *checkpoint) slice(key string) sliceCheckpoint {
+	if sc, ok := c.Slices[key]; ok {
+		return *sc
+	}
+	return sliceCheckpoint{}
+}
+
+func (d *dumper) initCheckpoint() {
+	// map keys must be sorted for the query to be comparable between runs
+	b, err := json.ConfigCompatibleWithStandardLibrary.Marshal(d.query)
+	if err != nil {
+		log.Fatal("marshaling query", "err", err)
+	}
+	query := string(b)
+
+	ck, err := loadCheckpoint(d.checkpoint)
+	if err != nil {
+		log.Fatal("loading checkpoint", "file", d.checkpoint, "err", err)
+	}
+	if ck == nil {
+		log.Info("no checkpoint found, starting from scratch", "file", d.checkpoint)
+		ck = &checkpoint{
+			Target:  d.target,
+			Query:   query,
+			Slices:  make(map[string]*sliceCheckpoint),
+			Indices: make(map[string]uint64),
+		}
+	} else {
+		if ck.Target != d.target || ck.Query != query {
+			log.Fatal("checkpoint was created for a different index target or query, run with the same arguments or remove it",
+				"file", d.checkpoint)
+		}
+		log.Info("resuming from checkpoint", "file", d.checkpoint, "dumped", ck.Dumped)
+		d.dumped = ck.Dumped
+		d.scrolled = ck.Dumped
+	}
+	ck.path = d.checkpoint
+	d.ckpt = ck
+}
+
+// saveCheckpoint flushes the output and saves the checkpoint, which then
+// matches exactly what has been written.
+func (d *dumper) saveCheckpoint() error {
+	if err := d.flushOutput(); err != nil {
+		return fmt.Errorf("flushing output: %w", err)
+	}
+	if d.zw != nil {
+		// a resumed dump starts a new compressed stream after the checkpoint
+		if err := d.restartCompression(); err != nil {
+			return fmt.Errorf("compressing output: %w", err)
+		}
+	}
+	// checkpoints are only allowed with local output files
+	f := d.outFile.(*os.File)
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing output: %w", err)
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("getting output offset: %w", err)
+	}
+	d.ckpt.OutputOffset = offset
+	if d.deadLetterOut != nil {
+		if err := d.syncDeadLetter(); err != nil {
+			return fmt.Errorf("syncing dead letter: %w", err)
+		}
+	}
+	d.ckpt.OutputPart = d.part
+	d.ckpt.PartDocs = d.partDocs
+	d.ckpt.Dumped = atomic.LoadUint64(&d.dumped)
+	if err := d.ckpt.save(); err != nil {
+		return fmt.Errorf("saving checkpoint: %w", err)
+	}
+	return nil
+}
+
+// resumePIT returns the point-in-time of the checkpoint if it is still alive,
+// or opens a new one.
+func (d *dumper) resumePIT(ctx context.Context) string {
+	pitID := d.ckpt.PitID
+	if pitID != "" {
+		if d.pitAlive(ctx, pitID) {
+			log.Info("resuming with point-in-time from checkpoint")
+			return pitID
+		}
+		if hasPositionalSort(d.query["sort"]) {
+			log.Fatal("the point-in-time of the checkpoint has expired, and the sort order is not stable across " +
+				"points-in-time so the dump cannot be resumed; to be able to resume after the point-in-time " +
+				"expires, sort on fields with unique values (e.g. {\"sort\": [\"date\", \"id\"]} on stdin)")
+		}
+		log.Warn("the point-in-time of the checkpoint has expired, resuming with a new point-in-time, the dump won't be a consistent snapshot")
+	}
+	pitID, err := d.openPIT(ctx, d.target)
+	if err != nil {
+		log.Fatal("unable to open point-in-time", "err", err)
+	}
+	d.ckpt.PitID = pitID
+	return pitID
+}
+
+func (d *dumper) pitAlive(ctx context.Context, pitID string) bool {
+	body, err := json.Marshal(obj{
+		"size": 0,
+		"pit": obj{
+			"id":         pitID,
+			"keep_alive": d.scrollTimeoutES,
+		},
+	})
+	if err != nil {
+		log.Fatal("marshaling search request", "err", err)
+	}
+	status, raw, err := d.cl.Get(ctx, "_search", string(body), nil)
+	if err != nil {
+		log.Fatal("checking point-in-time", "err", err)
+	}
+	if status == http.StatusOK {
+		return true
+	}
+	if status == http.StatusNotFound || strings.Contains(string(raw), "search_context_missing_exception") {
+		return false
+	}
+	log.Fatal("checking point-in-time, got unexpected status code", "code", status, "response", string(raw))
+	return false
+}
+
+// hasPositionalSort returns whether the sort depends on the position of the
+// documents in the shards (or on their score), rather than only on the values
+// of their fields.
+func hasPositionalSort(sort any) bool {
+	for _, field := range sortFields(sort) {
+		if field == "_doc" || field == "_shard_doc" || field == "_score" {
+			return true
+		}
+	}
+	return false
+}
+
+// sortFields returns the names of the fields of a sort, in any of the forms
+// accepted by Elasticsearch.
+func sortFields(sort any) []string {
+	var clauses []any
+	switch s := sort.(type) {
+	case nil:
+	case []any:
+		clauses = s
+	case []string:
+		for _, c := range s {
+			clauses = append(clauses, c)
+		}
+	default:
+		clauses = []any{s}
+	}
+
+	var fields []string
+	for _, clause := range clauses {
+		switch c := clause.(type) {
+		case string:
+			fields = append(fields, c)
+		case map[string]any:
+			for k := range c {
+				fields = append(fields, k)
+			}
+		case obj:
+			for k := range c {
+				fields = append(fields, k)
+			}
+		}
+	}
+	return fields
+}
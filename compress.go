@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// extensions appended to the names of the output files, by compression
+var compressExtensions = map[string]string{
+	compressGzip: ".gz",
+	compressZstd: ".zst",
+}
+
+// compressor compresses the output in blocks, on all the cores.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+func (d *dumper) newCompressor(w io.Writer) compressor {
+	switch d.compress {
+	case compressGzip:
+		level := pgzip.DefaultCompression
+		if d.compressLevel != 0 {
+			level = d.compressLevel
+		}
+		zw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			log.Fatal("creating gzip compressor", "err", err)
+		}
+		return zw
+	case compressZstd:
+		var opts []zstd.EOption
+		if d.compressLevel != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(d.compressLevel)))
+		}
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			log.Fatal("creating zstd compressor", "err", err)
+		}
+		return zw
+	}
+	return nil
+}
+
+// compressedPath returns the path of an output file with the extension of the
+// compression, unless it already has it.
+func (d *dumper) compressedPath(path string) string {
+	ext := compressExtensions[d.compress]
+	if strings.HasSuffix(path, ext) {
+		return path
+	}
+	return path + ext
+}
+
+// compressedBytes returns the number of bytes written to the compressors, and
+// written by them to the output files.
+func (d *dumper) compressedBytes() (raw, compressed int64) {
+	switch {
+	case d.tmpl != nil:
+		return d.tmpl.rawBytes, d.tmpl.compressedBytes
+	case d.zw != nil:
+		return d.rawCounter.total, d.outCounter.total
+	}
+	return 0, 0
+}
+
+// restartCompression completes the compressed stream, so that all that has
+// been written so far can be decompressed, and starts a new one. Concatenated
+// gzip members or zstd frames are decompressed as a single stream.
+func (d *dumper) restartCompression() error {
+	if err := d.zw.Close(); err != nil {
+		return err
+	}
+	d.zw.Reset(d.outCounter)
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+// numberJSON keeps the numbers as they were written, to output them without
+// any loss of precision nor change of notation.
+var numberJSON = json.Config{UseNumber: true}.Froze()
+
+// metadataColumns are the metadata columns available with --metadata.
+var metadataColumns = []string{"_index", "_id"}
+
+type mappingResp map[string]struct {
+	Mappings json.RawMessage `json:"mappings"`
+}
+
+type mappingProperties struct {
+	Type       string                       `json:"type"`
+	Properties map[string]mappingProperties `json:"properties"`
+}
+
+// initColumns sets the columns of the CSV/TSV output: the fields listed with
+// --fields, or else all the fields of the mappings of the indices, restricted
+// to the fields selected with --fields. Objects are expanded to the dotted
+// names of their fields.
+func (d *dumper) initColumns(ctx context.Context) {
+	var columns []string
+	if d.metadata || d.metadataOnly {
+		columns = append(columns, metadataColumns...)
+	}
+	if d.metadataOnly {
+		d.columns = columns
+		return
+	}
+
+	includes, excludes := sourceFilter(d.query["_source"])
+	mapped := d.mappingFields(ctx)
+	var fields []string
+	if len(includes) > 0 && !hasWildcard(includes) {
+		// keep the order of --fields, but expand the objects to their fields
+		for _, inc := range includes {
+			var sub []string
+			for _, f := range mapped {
+				if f == inc || strings.HasPrefix(f, inc+".") {
+					sub = append(sub, f)
+				}
+			}
+			if len(sub) == 0 {
+				sub = []string{inc}
+			}
+			fields = append(fields, sub...)
+		}
+	} else {
+		for _, f := range mapped {
+			if len(includes) == 0 || matchAny(includes, f) {
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if !matchAny(excludes, f) {
+			columns = append(columns, f)
+		}
+	}
+	if len(columns) == 0 {
+		log.Fatal("no field found in the mappings to use as columns, set them with --fields")
+	}
+	d.columns = columns
+}
+
+// mappingFields returns the dotted names of the leaf fields of the mappings of
+// all the indices of the target, sorted.
+func (d *dumper) mappingFields(ctx context.Context) []string {
+	set := make(map[string]struct{})
+	collectFields(set, "", d.getMappings(ctx))
+
+	fields := make([]string, 0, len(set))
+	for f := range set {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// getMappings returns the properties of the mappings of all the indices of the
+// target, merged.
+func (d *dumper) getMappings(ctx context.Context) map[string]mappingProperties {
+	var resp mappingResp
+	status, raw, err := d.cl.Get(ctx, d.target+"/_mapping", "", &resp)
+	if err != nil {
+		log.Fatal("getting the mappings", "err", err)
+	}
+	if status != http.StatusOK {
+		log.Fatal("getting the mappings, got unexpected status code", "code", status, "response", string(raw))
+	}
+
+	merged := make(map[string]mappingProperties)
+	for _, idx := range resp {
+		var props mappingProperties
+		if err := json.Unmarshal(idx.Mappings, &props); err != nil {
+			log.Fatal("parsing the mappings", "err", err)
+		}
+		if props.Properties == nil {
+			// before Elasticsearch 7, the mappings are keyed by type
+			var types map[string]mappingProperties
+			if err := json.Unmarshal(idx.Mappings, &types); err != nil {
+				log.Fatal("parsing the mappings", "err", err)
+			}
+			for _, t := range types {
+				mergeProperties(merged, t.Properties)
+			}
+			continue
+		}
+		mergeProperties(merged, props.Properties)
+	}
+	return merged
+}
+
+// mergeProperties adds the properties to dst. If a field has different types
+// in different indices, the first one is kept.
+func mergeProperties(dst, src map[string]mappingProperties) {
+	for name, p := range src {
+		existing, ok := dst[name]
+		if !ok {
+			dst[name] = p
+			continue
+		}
+		if existing.Properties != nil && p.Properties != nil {
+			mergeProperties(existing.Properties, p.Properties)
+		}
+	}
+}
+
+func collectFields(set map[string]struct{}, prefix string, props map[string]mappingProperties) {
+	for name, p := range props {
+		// nested documents are arrays of objects, they are output as JSON in
+		// a single column
+		if p.Properties != nil && p.Type != "nested" {
+			collectFields(set, prefix+name+".", p.Properties)
+			continue
+		}
+		set[prefix+name] = struct{}{}
+	}
+}
+
+// sourceFilter returns the includes and excludes of the _source option of the
+// query.
+func sourceFilter(source any) (includes, excludes []string) {
+	switch s := source.(type) {
+	case []string:
+		return s, nil
+	case []any:
+		return toStrings(s), nil
+	case string:
+		return []string{s}, nil
+	case obj:
+		return sourceFilter(map[string]any(s))
+	case map[string]any:
+		for _, k := range []string{"includes", "include"} {
+			inc, _ := sourceFilter(s[k])
+			includes = append(includes, inc...)
+		}
+		for _, k := range []string{"excludes", "exclude"} {
+			exc, _ := sourceFilter(s[k])
+			excludes = append(excludes, exc...)
+		}
+		return includes, excludes
+	}
+	return nil, nil
+}
+
+func toStrings(values []any) []string {
+	var strs []string
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+func hasWildcard(patterns []string) bool {
+	for _, p := range patterns {
+		if strings.Contains(p, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny returns whether the field matches one of the patterns of a _source
+// filter, either exactly, or as a subfield of an object, or with wildcards.
+func matchAny(patterns []string, field string) bool {
+	for _, p := range patterns {
+		if p == field || strings.HasPrefix(field, p+".") {
+			return true
+		}
+		if ok, _ := path.Match(p, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// csvEncoder writes each hit as a row of the columns, with nested objects
+// flattened to dotted column names.
+type csvEncoder struct {
+	w        *csv.Writer
+	columns  []string
+	isColumn map[string]bool
+	arraySep string
+	metadata bool
+	row      []string
+}
+
+func (d *dumper) newCSVEncoder(w *bufio.Writer, header bool) (*csvEncoder, error) {
+	cw := csv.NewWriter(w)
+	if d.format == formatTSV {
+		cw.Comma = '\t'
+	}
+	e := &csvEncoder{
+		w:        cw,
+		columns:  d.columns,
+		isColumn: make(map[string]bool),
+		arraySep: d.arraySeparator,
+		metadata: d.metadata || d.metadataOnly,
+		row:      make([]string, len(d.columns)),
+	}
+	for _, c := range d.columns {
+		e.isColumn[c] = true
+	}
+	if header {
+		if err := cw.Write(d.columns); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *csvEncoder) encode(h hit) error {
+	var doc map[string]any
+	if err := numberJSON.Unmarshal(h.doc, &doc); err != nil {
+		return fmt.Errorf("parsing hit: %w", err)
+	}
+
+	values := make(map[string][]string)
+	if e.metadata {
+		for _, c := range metadataColumns {
+			if v, ok := doc[c]; ok {
+				values[c] = []string{e.format(v)}
+			}
+		}
+		source, _ := doc["_source"].(map[string]any)
+		e.flatten(values, "", source)
+	} else {
+		e.flatten(values, "", doc)
+	}
+
+	for i, c := range e.columns {
+		e.row[i] = strings.Join(values[c], e.arraySep)
+	}
+	return e.w.Write(e.row)
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) close() error {
+	return e.flush()
+}
+
+// flatten adds the values of the leaf fields of the object, with dotted names.
+func (e *csvEncoder) flatten(values map[string][]string, prefix string, o map[string]any) {
+	for k, v := range o {
+		e.flattenValue(values, prefix+k, v)
+	}
+}
+
+// flattenValue adds the values of a field. The objects of an array are
+// flattened too, unless the array has its own column (e.g. a nested field), so
+// that each of their fields gets the values of all the objects, as in the
+// Elasticsearch mappings of arrays of objects.
+func (e *csvEncoder) flattenValue(values map[string][]string, name string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		e.flatten(values, name+".", v)
+	case []any:
+		if e.isColumn[name] || !hasObject(v) {
+			values[name] = append(values[name], e.format(v))
+			return
+		}
+		for _, elem := range v {
+			e.flattenValue(values, name, elem)
+		}
+	default:
+		values[name] = append(values[name], e.format(v))
+	}
+}
+
+func hasObject(values []any) bool {
+	for _, v := range values {
+		if _, ok := v.(map[string]any); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// format returns the value of a cell: strings are not quoted, arrays of values
+// are joined with the array separator, and objects are output as JSON.
+func (e *csvEncoder) format(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return string(v)
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case []any:
+		elems := make([]string, len(v))
+		for i, elem := range v {
+			elems[i] = e.format(elem)
+		}
+		return strings.Join(elems, e.arraySep)
+	default:
+		b, err := numberJSON.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestCSVEncoderArraysOfObjects(t *testing.T) {
+	d := dumper{
+		format:         formatCSV,
+		arraySeparator: "|",
+		columns:        []string{"comments.by", "comments.tags", "nested", "obj.x", "tags"},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	e, err := d.newCSVEncoder(w, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := `{
+		"comments": [{"by": "a", "tags": ["x", "y"]}, {"tags": "z"}, {"by": "b"}],
+		"nested": [{"k": 1}],
+		"obj": {"x": 1.50},
+		"tags": ["t1", "t2"]
+	}`
+	if err := e.encode(hit{doc: json.RawMessage(doc)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.close(); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	// the nested field has its own column, its objects are output as JSON
+	want := `a|b,x|y|z,"{""k"":1}",1.50,t1|t2` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
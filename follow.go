@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+// followUpperBound returns the upper bound (excluded) of the next poll of the
+// follow mode: the documents more recent than that may not be searchable yet,
+// or may still be indexed with an older timestamp.
+func (d *dumper) followUpperBound() int64 {
+	return time.Now().Add(-d.followLag).UnixMilli()
+}
+
+// followRange restricts the documents to the window [from, to) of the follow
+// field, in epoch milliseconds; from is ignored if negative.
+func (d *dumper) followRange(from, to int64) obj {
+	rng := obj{
+		"lt":     to,
+		"format": "epoch_millis",
+	}
+	if from >= 0 {
+		rng["gte"] = from
+	}
+	return obj{"range": obj{d.followField: rng}}
+}
+
+// tail keeps dumping the documents that follow the initial dump, until the
+// context is canceled. Each poll continues from the last hit returned by the
+// previous ones, rather than from the upper bound of the previous poll, so
+// that the documents that were not searchable yet when it ran are not missed.
+func (d *dumper) tail(ctx context.Context, from int64) error {
+	log.Info("initial dump complete, following new documents", "field", d.followField,
+		"interval", d.followInterval, "lag", d.followLag)
+	var after json.RawMessage
+	for {
+		cancelableSleep(ctx, d.followInterval)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if after != nil {
+			// the position is after the initial dump
+			from = -1
+		}
+		s := slice{
+			key:    "follow",
+			index:  d.target,
+			filter: d.followRange(from, d.followUpperBound()),
+		}
+		if err := d.poll(ctx, s, &after); err != nil {
+			return err
+		}
+		if d.countReached() {
+			return nil
+		}
+	}
+}
+
+// poll pages through the documents of the slice with search_after, from the
+// sort values of the last hit output. They are sorted on the follow field and
+// on the tiebreaker, whose values are the same in all the searches, unlike
+// the positions of a scroll or point-in-time, so a single position can be kept
+// across polls.
+func (d *dumper) poll(ctx context.Context, s slice, after *json.RawMessage) error {
+	ps := &pageSize{n: d.size}
+	d.totalHitsCtr.Add(1)
+	reported := false
+	for {
+		q := d.sliceQuery(s)
+		q["sort"] = []any{
+			obj{d.followField: obj{"order": "asc"}},
+			obj{d.followTiebreaker: obj{"order": "asc"}},
+		}
+		if *after != nil {
+			q["search_after"] = *after
+		}
+
+		reqStart := time.Now()
+		resp, more, err := d.scrollRequest(ctx, s.key, s.index+"/_search", ps, nil, func() string {
+			q["size"] = ps.n
+			qBytes, err := json.Marshal(q)
+			if err != nil {
+				log.Fatal("marshaling search request", "err", err)
+			}
+			return string(qBytes)
+		})
+		if !reported {
+			var total uint64
+			if resp != nil {
+				total = resp.GetTotal()
+			}
+			d.totalHitsCtr.Report(total)
+			reported = true
+		}
+		if err != nil {
+			return err
+		}
+		if last := resp.GetLastSort(); last != nil {
+			*after = last
+		}
+		if !more {
+			return nil
+		}
+		cancelableSleep(ctx, d.throttlingDuration(time.Since(reqStart)))
+	}
+}
+
+// addFilter restricts the slice with an additional filter.
+func addFilter(s *slice, filter obj) {
+	if s.filter == nil {
+		s.filter = filter
+		return
+	}
+	s.filter = obj{
+		"bool": obj{
+			"filter": []any{s.filter, filter},
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	formatJSONL   = "jsonl"
+	formatCSV     = "csv"
+	formatTSV     = "tsv"
+	formatParquet = "parquet"
+	formatBulk    = "bulk"
+)
+
+// encoder writes the hits to the output in a given format.
+type encoder interface {
+	encode(h hit) error
+	// flush writes what the encoder may have buffered to the underlying
+	// writer, so that the checkpoint matches what has been written.
+	flush() error
+	// close writes what the format needs at the end of the output, e.g. the
+	// footer of a Parquet file.
+	close() error
+}
+
+// newEncoder returns the encoder of the output format. The header, if the
+// format has one, is only written if the output is empty, i.e. not when
+// appending to it to resume a dump.
+func (d *dumper) newEncoder(w *bufio.Writer, header bool) (encoder, error) {
+	switch d.format {
+	case formatCSV, formatTSV:
+		return d.newCSVEncoder(w, header)
+	case formatParquet:
+		return d.newParquetEncoder(w)
+	case formatBulk:
+		return d.newBulkEncoder(w), nil
+	default:
+		return &jsonlEncoder{w: w}, nil
+	}
+}
+
+// jsonlEncoder writes each hit as a line of JSON.
+type jsonlEncoder struct {
+	w    *bufio.Writer
+	line lineCompactor
+}
+
+func (e *jsonlEncoder) encode(h hit) error {
+	doc, err := e.line.compact(h.doc)
+	if err != nil {
+		return err
+	}
+	if _, err := e.w.Write(doc); err != nil {
+		return err
+	}
+	return e.w.WriteByte('\n')
+}
+
+// lineCompactor puts JSON documents on a single line.
+type lineCompactor struct {
+	buf bytes.Buffer
+}
+
+// compact returns the document on a single line. The returned slice is only
+// valid until the next call.
+func (c *lineCompactor) compact(doc []byte) ([]byte, error) {
+	// Elasticsearch returns the document's _source exactly as it was
+	// indexed: if it was indexed with newlines, it will return newlines.
+	// But for the JSONL format, each hit must be on its own line.
+	// So we need to check if there are newlines, and remove them.
+	if bytes.IndexByte(doc, '\n') == -1 {
+		return doc, nil
+	}
+	c.buf.Reset()
+	if err := json.Compact(&c.buf, doc); err != nil {
+		return nil, fmt.Errorf("compacting hit into single-line JSON: %w", err)
+	}
+	return c.buf.Bytes(), nil
+}
+
+func (e *jsonlEncoder) flush() error {
+	return nil
+}
+
+func (e *jsonlEncoder) close() error {
+	return nil
+}
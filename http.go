@@ -141,6 +141,10 @@ func (cl *httpClient) Get(ctx context.Context, path string, body string, dst any
 	return cl.Do(ctx, http.MethodGet, path, body, dst)
 }
 
+func (cl *httpClient) Post(ctx context.Context, path string, body string, dst any) (int, []byte, error) {
+	return cl.Do(ctx, http.MethodPost, path, body, dst)
+}
+
 func (cl *httpClient) Delete(ctx context.Context, path string, body string, dst any) (int, []byte, error) {
 	return cl.Do(ctx, http.MethodDelete, path, body, dst)
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+// incrementalState records the bounds of the incremental dumps. Each dump
+// covers the closed range [From, To] of the incremental field, where To is the
+// max value of the field when the dump starts. Documents indexed with that
+// same value during the dump may not be found by it, so the next dump starts
+// from it again, and skips the documents that have been dumped with it, so
+// that no document is missed nor dumped twice at the boundary.
+type incrementalState struct {
+	Target string `json:"target"`
+	Field  string `json:"field"`
+	Date   bool   `json:"date,omitempty"`
+	// lower bound of the next dump, nil before the first complete dump,
+	// kept as written by the server as the doubles of large longs aren't
+	// exact
+	From *json.Number `json:"from,omitempty"`
+	// documents dumped with the value of the lower bound, by index/_id
+	FromIDs []string `json:"from_ids,omitempty"`
+	// upper bound of a dump that has not completed yet, reused by the next
+	// run so that it dumps the same range and can be resumed from a
+	// checkpoint
+	To *json.Number `json:"to,omitempty"`
+	// bounds of each shard, by index/shard, with the _seq_no incremental
+	// field
+	Shards map[string]*seqNoRange `json:"shards,omitempty"`
+
+	path    string
+	mu      sync.Mutex
+	fromIDs map[string]bool
+	toIDs   map[string]bool
+}
+
+func loadIncrementalState(path string) (*incrementalState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s incrementalState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing state: %w", err)
+	}
+	return &s, nil
+}
+
+func (s *incrementalState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// initIncremental restricts the query to the documents whose incremental field
+// is in the range not dumped yet. It returns false if there is nothing to dump.
+func (d *dumper) initIncremental(ctx context.Context) bool {
+	st, err := loadIncrementalState(d.state)
+	if err != nil {
+		log.Fatal("loading state", "file", d.state, "err", err)
+	}
+	if st == nil {
+		log.Info("no state found, dumping all documents", "file", d.state)
+		st = &incrementalState{
+			Target: d.target,
+			Field:  d.incrementalField,
+		}
+	} else if st.Target != d.target || st.Field != d.incrementalField {
+		log.Fatal("state was created for a different index target or incremental field, run with the same arguments or remove it",
+			"file", d.state)
+	}
+	st.path = d.state
+	d.incrState = st
+
+	if d.incrementalField == seqNoField {
+		d.initSeqNoBounds(ctx, st)
+		if d.metadata {
+			d.query["seq_no_primary_term"] = true
+		}
+		return true
+	}
+
+	if st.To == nil {
+		upper, isDate := d.fieldMax(ctx)
+		if upper == nil {
+			log.Info("no document has a value for the incremental field, nothing to do", "field", d.incrementalField)
+			return false
+		}
+		st.To = upper
+		st.Date = isDate
+		// saved before dumping, so that a failed dump is retried with the
+		// same range
+		if err := st.save(); err != nil {
+			log.Fatal("saving state", "file", d.state, "err", err)
+		}
+	} else {
+		log.Info("resuming the previous incremental dump, which didn't complete", "file", d.state)
+	}
+
+	rng := obj{"lte": *st.To}
+	if st.From != nil {
+		rng["gte"] = *st.From
+	}
+	st.fromIDs = make(map[string]bool, len(st.FromIDs))
+	for _, id := range st.FromIDs {
+		st.fromIDs[id] = true
+	}
+	st.toIDs = make(map[string]bool)
+	// the values of the field of each hit tell which hits are at the bounds
+	d.addDocValueField(d.incrementalField, st.Date)
+	if st.Date {
+		rng["format"] = "epoch_millis"
+	}
+	from := "(none)"
+	if st.From != nil {
+		from = st.boundString(*st.From)
+	}
+	log.Info("incremental dump", "field", d.incrementalField, "from", from, "to", st.boundString(*st.To))
+
+	d.query["query"] = obj{
+		"bool": obj{
+			"must":   d.query["query"],
+			"filter": obj{"range": obj{d.incrementalField: rng}},
+		},
+	}
+	return true
+}
+
+// commitIncremental records that the range of the dump has been completely
+// dumped, so that the next dump starts from its upper bound.
+func (d *dumper) commitIncremental() {
+	st := d.incrState
+	if d.incrementalField == seqNoField {
+		for _, r := range st.Shards {
+			if r.To != nil {
+				r.From = r.To
+				r.To = nil
+			}
+		}
+		if err := st.save(); err != nil {
+			log.Error("saving state", "file", d.state, "err", err)
+			return
+		}
+		log.Info("saved state for the next incremental dump", "file", d.state, "shards", len(st.Shards))
+		return
+	}
+
+	st.From = st.To
+	st.FromIDs = make([]string, 0, len(st.toIDs))
+	for id := range st.toIDs {
+		st.FromIDs = append(st.FromIDs, id)
+	}
+	sort.Strings(st.FromIDs)
+	st.To = nil
+	if err := st.save(); err != nil {
+		log.Error("saving state", "file", d.state, "err", err)
+		return
+	}
+	log.Info("saved state for the next incremental dump", "file", d.state, "from", st.boundString(*st.From))
+}
+
+// incrementalHits skips the hits that have already been dumped with the value
+// of the lower bound, and records the ones dumped with the value of the upper
+// bound.
+func (d *dumper) incrementalHits(hits []hit) []hit {
+	st := d.incrState
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	kept := hits[:0]
+	for _, h := range hits {
+		key := h.index + "/" + h.id
+		var atFrom, atTo bool
+		for _, v := range fieldValues(h.fields, d.incrementalField) {
+			atFrom = atFrom || st.From != nil && v == string(*st.From)
+			atTo = atTo || v == string(*st.To)
+		}
+		if atTo {
+			st.toIDs[key] = true
+		}
+		if atFrom && st.fromIDs[key] {
+			continue
+		}
+		kept = append(kept, h)
+	}
+	return kept
+}
+
+func (s *incrementalState) boundString(v json.Number) string {
+	if s.Date {
+		if ms, err := v.Int64(); err == nil {
+			return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return v.String()
+}
+
+// fieldMax returns the max value of the incremental field over the documents
+// of the query, and whether it is a date. The max aggregation tells whether
+// the field is a date, and gives its value in epoch millis, but its value is
+// a double which isn't exact for large longs, so the value of the other
+// fields is taken from the sort values of the top document.
+func (d *dumper) fieldMax(ctx context.Context) (*json.Number, bool) {
+	body, err := json.Marshal(obj{
+		"size":    1,
+		"_source": false,
+		"query":   d.query["query"],
+		"sort":    []any{obj{d.incrementalField: obj{"order": "desc"}}},
+		"aggs": obj{
+			"max": obj{"max": obj{"field": d.incrementalField}},
+		},
+	})
+	if err != nil {
+		log.Fatal("marshaling max query", "err", err)
+	}
+
+	var resp struct {
+		fieldRangeResp
+		Hits struct {
+			Hits []struct {
+				Sort []json.Number `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	status, raw, err := d.cl.Get(ctx, d.target+"/_search", string(body), &resp)
+	if err != nil {
+		log.Fatal("getting the max value of the incremental field", "err", err)
+	}
+	if status != http.StatusOK {
+		log.Fatal("getting the max value of the incremental field, got unexpected status code", "code", status, "response", string(raw))
+	}
+	m := resp.Aggregations.Max
+	if m.Value == nil {
+		return nil, false
+	}
+	// only date fields have a string representation of their values
+	if m.ValueAsString != "" {
+		v := json.Number(strconv.FormatInt(int64(*m.Value), 10))
+		return &v, true
+	}
+	if len(resp.Hits.Hits) == 0 || len(resp.Hits.Hits[0].Sort) == 0 {
+		log.Fatal("getting the max value of the incremental field, missing sort values in the response", "response", string(raw))
+	}
+	v := resp.Hits.Hits[0].Sort[0]
+	return &v, false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestIncrementalHits(t *testing.T) {
+	// a large long, whose double isn't exact
+	from := json.Number("9007199254740993")
+	to := json.Number("9007199254740995")
+	d := dumper{
+		incrementalField: "v",
+		incrState: &incrementalState{
+			From:    &from,
+			To:      &to,
+			fromIDs: map[string]bool{"i/a": true, "i/b": true},
+			toIDs:   make(map[string]bool),
+		},
+	}
+	valueHit := func(id, values string) hit {
+		return hit{index: "i", id: id, fields: json.RawMessage(`{"v":` + values + `}`)}
+	}
+	got := d.incrementalHits([]hit{
+		// dumped by the previous dump
+		valueHit("a", "[9007199254740993]"),
+		// indexed at the bound after the previous dump
+		valueHit("c", "[9007199254740993]"),
+		// updated since the previous dump
+		valueHit("b", "[9007199254740994]"),
+		valueHit("d", "[9007199254740992,9007199254740995]"),
+		valueHit("e", "[9007199254740995]"),
+	})
+	if want := []string{"i/c", "i/b", "i/d", "i/e"}; !reflect.DeepEqual(hitIDs(got), want) {
+		t.Errorf("got %v, want %v", hitIDs(got), want)
+	}
+	if want := map[string]bool{"i/d": true, "i/e": true}; !reflect.DeepEqual(d.incrState.toIDs, want) {
+		t.Errorf("ids at the upper bound: got %v, want %v", d.incrState.toIDs, want)
+	}
+}
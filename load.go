@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/spf13/pflag"
+	"golang.org/x/sync/errgroup"
+)
+
+// loader indexes a JSONL dump into Elasticsearch. It reuses the connection,
+// throttling and retry settings of the dumper.
+type loader struct {
+	dumper
+	index      string
+	input      string
+	op         string
+	batchDocs  int
+	batchBytes byteSize
+	workers    int
+
+	idx   *bulkIndexer
+	lines uint64
+}
+
+func loadMain(args []string) {
+	var l loader
+	flags := pflag.NewFlagSet("esdump load", pflag.ContinueOnError)
+
+	usage := func() {
+		fmt.Fprint(os.Stderr, `esdump load base-url [index] [flags]
+
+Indexes the documents of a JSONL dump into Elasticsearch, with concurrent
+requests to the _bulk API. The dump is read from standard input, or from the
+file set with -i/--input, and may be compressed with gzip or zstd.
+
+Each line is either the _source of a document, to index into the index given as
+argument, or with -m/--metadata a hit with its metadata (_index, _id, _routing
+and _source, as output by esdump -m), to index into its original index or into
+the index given as argument, in which {index} is replaced by the original index.
+
+As when dumping, the requests are throttled by default. To go faster, turn off
+throttling with -t0
+
+Examples:
+
+  esdump load http://localhost myindex < myindex.jsonl
+  esdump load http://localhost -m -i dump.jsonl.zst
+  esdump load http://localhost 'restored-{index}' -m -i dump.jsonl --op create
+
+Flags:
+
+`)
+		flags.PrintDefaults()
+	}
+	flags.Usage = usage
+
+	flags.BoolVarP(&l.metadata,
+		"metadata", "m", false, "the documents are hits with metadata (_index, _id, _source...), as output by esdump -m")
+	flags.StringVarP(&l.input,
+		"input", "i", "", "read the documents from this file instead of standard input")
+	flags.StringVar(&l.op,
+		"op", bulkOpIndex, "bulk operation: index, create to skip the existing documents, or update to update them (with doc_as_upsert)")
+	flags.IntVar(&l.batchDocs,
+		"batch-size", 1000, "max number of documents per bulk request")
+	l.batchBytes = 10 << 20
+	flags.Var(&l.batchBytes,
+		"batch-bytes", "max size of a bulk request")
+	flags.IntVar(&l.workers,
+		"workers", 4, "number of bulk requests sent at the same time")
+	flags.Float32VarP(&l.throttle,
+		"throttle", "t", 4, "delay factor for adaptive throttling, set 0 to disable throttling")
+	flags.BoolVarP(&l.noCompression,
+		"no-compression", "z", false, "disable HTTP gzip compression")
+	flags.StringVar(&l.verify,
+		"verify", "", "certificate file to verify the server's certificate, or \"no\" to skip all TLS verification")
+	flags.DurationVar(&l.httpTimeout,
+		"http-timeout", time.Minute, "HTTP client timeout")
+	flags.IntVar(&l.retries,
+		"retries", 5, "max number of retries of a failed bulk request or rejected document, set 0 to disable retrying")
+	flags.DurationVar(&l.retryBackoffBase,
+		"retry-backoff", time.Second, "initial delay before retrying, doubled after each retry")
+	flags.SortFlags = false
+
+	err := flags.Parse(args)
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Error("parsing flags", "err", err)
+		usage()
+		os.Exit(1)
+	}
+
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		log.Error("one or two arguments expected")
+		usage()
+		os.Exit(1)
+	}
+	esURL, err := url.Parse(args[0])
+	if err != nil || esURL.Scheme == "" {
+		log.Error("first argument must be an URL")
+		usage()
+		os.Exit(1)
+	}
+	if len(args) == 2 {
+		l.index = args[1]
+	}
+
+	if errs := l.validateFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		usage()
+		os.Exit(1)
+	}
+
+	l.setBaseURL(esURL)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	l.load(ctx)
+}
+
+func (l *loader) validateFlags() []string {
+	var errs []string
+	if l.index == "" && !l.metadata {
+		errs = append(errs, "an index is required, unless the documents have metadata (--metadata)")
+	}
+	if strings.Contains(l.index, "{index}") && !l.metadata {
+		errs = append(errs, "{index} in the index requires metadata (--metadata)")
+	}
+	switch l.op {
+	case bulkOpIndex, bulkOpCreate, bulkOpUpdate:
+	default:
+		errs = append(errs, "op must be one of index, create or update")
+	}
+	if l.batchDocs < 1 {
+		errs = append(errs, "batch-size must be >= 1")
+	}
+	if l.workers < 1 {
+		errs = append(errs, "workers must be >= 1")
+	}
+	if l.throttle < 0 {
+		errs = append(errs, "throttle must be >= 0")
+	}
+	if l.httpTimeout < 0 {
+		errs = append(errs, "http-timeout must be >= 0")
+	}
+	if l.retries < 0 {
+		errs = append(errs, "retries must be >= 0")
+	}
+	if l.retryBackoffBase < 0 {
+		errs = append(errs, "retry-backoff must be >= 0")
+	}
+	return errs
+}
+
+func (l *loader) load(ctx context.Context) {
+	l.init()
+	l.server = l.getServerInfo(ctx)
+
+	in, closeInput := l.openInput()
+	defer closeInput()
+
+	l.idx = l.newBulkIndexer(&l.cl, l.server, l.op, l.batchDocs, int64(l.batchBytes), l.workers)
+	log.Info("loading", "op", l.op, "batch_size", l.batchDocs, "workers", l.workers, "throttle", l.throttle)
+	l.start = time.Now()
+
+	workers, ctx := errgroup.WithContext(ctx)
+	workers.Go(func() error {
+		err := l.read(ctx, in)
+		if closeErr := l.idx.close(ctx); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	workers.Go(func() error {
+		return l.idx.run(ctx)
+	})
+
+	stopLoadStatus := l.loadStatus()
+	err := workers.Wait()
+	stopLoadStatus()
+
+	took := time.Since(l.start)
+	indexed := atomic.LoadUint64(&l.idx.indexed)
+	stats := []any{
+		"took", took.Round(time.Millisecond),
+		"indexed", indexed,
+		"speed", fmt.Sprintf("%.2f docs/sec", float64(indexed)/took.Seconds()),
+	}
+	if existing := atomic.LoadUint64(&l.idx.existing); existing > 0 {
+		stats = append(stats, "existing", existing)
+	}
+	if failed := atomic.LoadUint64(&l.idx.failed); failed > 0 {
+		stats = append(stats, "failed", failed)
+	}
+	if retried := atomic.LoadUint64(&l.retried); retried > 0 {
+		stats = append(stats, "retries", retried)
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		log.Warn("load canceled before completion", stats...)
+	case err != nil:
+		log.Error("load failed", append(stats, "err", err)...)
+	case atomic.LoadUint64(&l.idx.failed) > 0:
+		log.Warn("load complete, but some documents were rejected", stats...)
+	default:
+		log.Info("load complete", stats...)
+	}
+}
+
+// openInput opens the input, and decompresses it if it starts with the magic
+// number of gzip or zstd.
+func (l *loader) openInput() (io.Reader, func()) {
+	var f *os.File = os.Stdin
+	if l.input != "" {
+		var err error
+		f, err = os.Open(l.input)
+		if err != nil {
+			log.Fatal("opening input file", "err", err)
+		}
+	}
+	br := bufio.NewReaderSize(f, 1<<20)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := pgzip.NewReader(br)
+		if err != nil {
+			log.Fatal("reading gzip input", "err", err)
+		}
+		return zr, func() { zr.Close(); f.Close() }
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			log.Fatal("reading zstd input", "err", err)
+		}
+		return zr, func() { zr.Close(); f.Close() }
+	}
+	return br, func() { f.Close() }
+}
+
+// read reads the documents, one per line, and adds them to the indexer. The
+// lines that cannot be parsed are logged and skipped.
+func (l *loader) read(ctx context.Context, in io.Reader) error {
+	br := bufio.NewReaderSize(in, 1<<20)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			n := atomic.AddUint64(&l.lines, 1)
+			doc, parseErr := l.parse(bytes.TrimSpace(line))
+			if parseErr != nil {
+				log.Error("invalid document", "line", n, "err", parseErr)
+				atomic.AddUint64(&l.idx.failed, 1)
+			} else if err := l.idx.add(ctx, doc); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading input: %w", err)
+		}
+	}
+}
+
+func (l *loader) parse(line []byte) (bulkDoc, error) {
+	if !l.metadata {
+		if !json.Valid(line) || line[0] != '{' {
+			return bulkDoc{}, errors.New("not a JSON object")
+		}
+		return bulkDoc{index: l.index, source: line}, nil
+	}
+
+	var h bulkHit
+	if err := json.Unmarshal(line, &h); err != nil {
+		return bulkDoc{}, fmt.Errorf("parsing hit: %w", err)
+	}
+	if len(h.Source) == 0 {
+		return bulkDoc{}, fmt.Errorf("hit %s/%s has no _source", h.Index, h.ID)
+	}
+	doc := bulkDoc{
+		index:   h.Index,
+		typ:     h.Type,
+		id:      h.ID,
+		routing: h.Routing,
+		source:  h.Source,
+	}
+	if l.index != "" {
+		doc.index = strings.ReplaceAll(l.index, "{index}", h.Index)
+	}
+	if doc.index == "" {
+		return bulkDoc{}, errors.New("hit has no _index, set the index as argument")
+	}
+	return doc, nil
+}
+
+func (l *loader) loadStatus() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for {
+			select {
+			case <-ctx.Done():
+				close(done)
+				return
+			case <-ticker.C:
+				stats := []any{
+					"read", atomic.LoadUint64(&l.lines),
+					"indexed", atomic.LoadUint64(&l.idx.indexed),
+				}
+				if failed := atomic.LoadUint64(&l.idx.failed); failed > 0 {
+					stats = append(stats, "failed", failed)
+				}
+				if retried := atomic.LoadUint64(&l.retried); retried > 0 {
+					stats = append(stats, "retries", retried)
+				}
+				log.Info("loading...", stats...)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	json "github.com/json-iterator/go"
+)
+
+// pageMerger merges the pages of the slices of a seeded random dump by
+// descending random score, so that the order of the output only depends on
+// the seed and the data, and not on which slices are the fastest.
+type pageMerger struct {
+	// slices to merge, in the order used to break ties
+	keys  []string
+	pages map[string]chan page
+	// closed when the merger stops, e.g. once the count limit is reached
+	stopped chan struct{}
+}
+
+func newPageMerger(keys []string) *pageMerger {
+	m := &pageMerger{
+		keys:    keys,
+		pages:   make(map[string]chan page),
+		stopped: make(chan struct{}),
+	}
+	for _, key := range keys {
+		// one page of prefetch, so that the slice fetches its next page
+		// while the previous one is merged
+		m.pages[key] = make(chan page, 1)
+	}
+	return m
+}
+
+// add sends a page of a slice to the merger and returns whether the slice
+// must stop.
+func (m *pageMerger) add(p page) bool {
+	select {
+	case m.pages[p.slice] <- p:
+		return false
+	case <-m.stopped:
+		return true
+	}
+}
+
+// mergeKey is the position of a hit in the merged order: descending score,
+// then ascending sequence number.
+type mergeKey struct {
+	score float64
+	seqNo int64
+}
+
+func parseMergeKey(sort json.RawMessage) (mergeKey, error) {
+	var values []json.Number
+	if err := json.Unmarshal(sort, &values); err != nil || len(values) < 2 {
+		return mergeKey{}, fmt.Errorf("expected the score and sequence number as sort values, got %s", sort)
+	}
+	score, err := values[0].Float64()
+	if err != nil {
+		return mergeKey{}, fmt.Errorf("parsing score: %w", err)
+	}
+	seqNo, err := values[1].Int64()
+	if err != nil {
+		return mergeKey{}, fmt.Errorf("parsing sequence number: %w", err)
+	}
+	return mergeKey{score: score, seqNo: seqNo}, nil
+}
+
+// mergeHead is the page of a slice being merged.
+type mergeHead struct {
+	rank int
+	page page
+	keys []mergeKey
+	// next hit to output
+	i int
+}
+
+// before returns whether the hit at i comes before the next hit of the other
+// slice in the merged order.
+func (h *mergeHead) before(i int, other *mergeHead) bool {
+	a, b := h.keys[i], other.keys[other.i]
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	if a.seqNo != b.seqNo {
+		return a.seqNo < b.seqNo
+	}
+	return h.rank < other.rank
+}
+
+// run merges the pages until all the slices are done, and sends the merged
+// pages to output, until it returns true. Each merged page holds consecutive
+// hits of a single slice, so that the checkpoints still know up to where
+// each slice has been written.
+func (m *pageMerger) run(ctx context.Context, output func(page) bool) error {
+	defer close(m.stopped)
+
+	heads := make(map[string]*mergeHead)
+	pending := make(map[string]int)
+	for i, key := range m.keys {
+		pending[key] = i
+	}
+	for len(pending) > 0 {
+		// a hit can only be output once the next hit of every slice is known
+		for key, rank := range pending {
+			for heads[key] == nil {
+				var p page
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case p = <-m.pages[key]:
+				}
+				if len(p.hits) == 0 {
+					if !p.done {
+						continue
+					}
+					delete(pending, key)
+					if output(p) {
+						return nil
+					}
+					break
+				}
+				h := &mergeHead{rank: rank, page: p, keys: make([]mergeKey, len(p.hits))}
+				for i := range p.hits {
+					var err error
+					if h.keys[i], err = parseMergeKey(p.hits[i].sort); err != nil {
+						return err
+					}
+				}
+				heads[key] = h
+			}
+		}
+		if len(heads) == 0 {
+			continue
+		}
+
+		var best, second *mergeHead
+		for _, h := range heads {
+			switch {
+			case best == nil || h.before(h.i, best):
+				best, second = h, best
+			case second == nil || h.before(h.i, second):
+				second = h
+			}
+		}
+		end := best.i + 1
+		for end < len(best.keys) && (second == nil || best.before(end, second)) {
+			end++
+		}
+		hits := best.page.hits[best.i:end]
+		merged := page{
+			slice:       best.page.slice,
+			hits:        hits,
+			searchAfter: hits[len(hits)-1].sort,
+			done:        best.page.done && end == len(best.keys),
+		}
+		best.i = end
+		if best.i == len(best.keys) {
+			delete(heads, best.page.slice)
+			if best.page.done {
+				delete(pending, best.page.slice)
+			}
+		}
+		if output(merged) {
+			return nil
+		}
+	}
+	return nil
+}
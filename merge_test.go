@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func scoredHit(id string, score float64, seqNo int) hit {
+	return testHit("i", id, fmt.Sprintf("[%v,%d]", score, seqNo))
+}
+
+func TestPageMerger(t *testing.T) {
+	slices := map[string][]page{
+		"0": {
+			{slice: "0", hits: []hit{scoredHit("a", 0.9, 1), scoredHit("b", 0.8, 2)}},
+			{slice: "0", hits: []hit{scoredHit("c", 0.7, 3), scoredHit("d", 0.2, 4)}, done: true},
+		},
+		"1": {
+			{slice: "1", hits: []hit{scoredHit("e", 0.95, 1), scoredHit("f", 0.7, 3)}},
+			{slice: "1"},
+			{slice: "1", hits: []hit{scoredHit("g", 0.1, 2)}, done: true},
+		},
+		// an empty slice
+		"2": {{slice: "2", done: true}},
+	}
+	m := newPageMerger([]string{"0", "1", "2"})
+	for _, pages := range slices {
+		pages := pages
+		go func() {
+			for _, p := range pages {
+				if m.add(p) {
+					return
+				}
+			}
+		}()
+	}
+
+	var got []string
+	var done []string
+	err := m.run(context.Background(), func(p page) bool {
+		for _, h := range p.hits {
+			got = append(got, p.slice+h.id)
+		}
+		if p.done {
+			done = append(done, p.slice)
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// f comes after c, with the same score and sequence number but a lower
+	// rank
+	want := []string{"1e", "0a", "0b", "0c", "1f", "0d", "1g"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(done) != 3 {
+		t.Errorf("done slices: got %v, want all 3", done)
+	}
+}
+
+func TestPageMergerStop(t *testing.T) {
+	m := newPageMerger([]string{"0"})
+	stopped := make(chan bool)
+	go func() {
+		// the slice is blocked until the merger stops, the buffered page
+		// aside
+		for i := 0; i < 3; i++ {
+			if m.add(page{slice: "0", hits: []hit{scoredHit("a", 0.9, i)}}) {
+				stopped <- true
+				return
+			}
+		}
+		stopped <- false
+	}()
+	err := m.run(context.Background(), func(p page) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-stopped {
+		t.Error("the slice wasn't stopped after the merger")
+	}
+}
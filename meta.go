@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/pflag"
+)
+
+// unmarshalMeta unmarshals definitions, keeping the numbers as they were
+// written. They are written back by encoding/json, with sorted keys, so that two
+// exports of the same definitions are identical.
+func unmarshalMeta(raw []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// metaKind is a kind of cluster metadata: where to get its definitions, and
+// how to turn them into the bodies of the requests that re-apply them.
+type metaKind struct {
+	dir       string
+	endpoint  string
+	supported func(serverInfo) bool
+	// parse returns the body of each definition of the response, by name
+	parse func(raw []byte) (map[string]any, error)
+	// apply is the request that re-applies a definition
+	apply string
+}
+
+var metaKinds = []metaKind{
+	{
+		dir:      "index_templates",
+		endpoint: "_index_template",
+		supported: func(s serverInfo) bool {
+			return s.isOpenSearch() || s.atLeast(7, 8)
+		},
+		parse: func(raw []byte) (map[string]any, error) {
+			var resp struct {
+				IndexTemplates []struct {
+					Name          string `json:"name"`
+					IndexTemplate any    `json:"index_template"`
+				} `json:"index_templates"`
+			}
+			if err := unmarshalMeta(raw, &resp); err != nil {
+				return nil, err
+			}
+			defs := make(map[string]any, len(resp.IndexTemplates))
+			for _, t := range resp.IndexTemplates {
+				defs[t.Name] = t.IndexTemplate
+			}
+			return defs, nil
+		},
+		apply: "PUT _index_template/{name}",
+	},
+	{
+		dir:      "component_templates",
+		endpoint: "_component_template",
+		supported: func(s serverInfo) bool {
+			return s.isOpenSearch() || s.atLeast(7, 8)
+		},
+		parse: func(raw []byte) (map[string]any, error) {
+			var resp struct {
+				ComponentTemplates []struct {
+					Name              string `json:"name"`
+					ComponentTemplate any    `json:"component_template"`
+				} `json:"component_templates"`
+			}
+			if err := unmarshalMeta(raw, &resp); err != nil {
+				return nil, err
+			}
+			defs := make(map[string]any, len(resp.ComponentTemplates))
+			for _, t := range resp.ComponentTemplates {
+				defs[t.Name] = t.ComponentTemplate
+			}
+			return defs, nil
+		},
+		apply: "PUT _component_template/{name}",
+	},
+	{
+		dir:      "ilm_policies",
+		endpoint: "_ilm/policy",
+		supported: func(s serverInfo) bool {
+			// OpenSearch has its own index state management instead
+			return !s.isOpenSearch() && s.atLeast(6, 6)
+		},
+		parse: func(raw []byte) (map[string]any, error) {
+			// the version, modified date and usage are set by the server
+			var resp map[string]struct {
+				Policy any `json:"policy"`
+			}
+			if err := unmarshalMeta(raw, &resp); err != nil {
+				return nil, err
+			}
+			defs := make(map[string]any, len(resp))
+			for name, p := range resp {
+				defs[name] = obj{"policy": p.Policy}
+			}
+			return defs, nil
+		},
+		apply: "PUT _ilm/policy/{name}",
+	},
+	{
+		dir:      "ingest_pipelines",
+		endpoint: "_ingest/pipeline",
+		parse: func(raw []byte) (map[string]any, error) {
+			var resp map[string]any
+			if err := unmarshalMeta(raw, &resp); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		},
+		apply: "PUT _ingest/pipeline/{name}",
+	},
+	{
+		dir:      "aliases",
+		endpoint: "_alias",
+		parse: func(raw []byte) (map[string]any, error) {
+			var resp map[string]struct {
+				Aliases map[string]obj `json:"aliases"`
+			}
+			if err := unmarshalMeta(raw, &resp); err != nil {
+				return nil, err
+			}
+			indices := make([]string, 0, len(resp))
+			for index := range resp {
+				indices = append(indices, index)
+			}
+			sort.Strings(indices)
+
+			// an alias may span several indices, so all of them are added
+			// back by the same request
+			actions := make(map[string][]any)
+			for _, index := range indices {
+				for alias, props := range resp[index].Aliases {
+					add := obj{"index": index, "alias": alias}
+					for k, v := range props {
+						add[k] = v
+					}
+					actions[alias] = append(actions[alias], obj{"add": add})
+				}
+			}
+			defs := make(map[string]any, len(actions))
+			for alias, acts := range actions {
+				defs[alias] = obj{"actions": acts}
+			}
+			return defs, nil
+		},
+		apply: "POST _aliases",
+	},
+}
+
+// metaDumper exports the cluster metadata to JSON files.
+type metaDumper struct {
+	dumper
+	patterns  []string
+	outputDir string
+}
+
+func metaMain(args []string) {
+	var m metaDumper
+	flags := pflag.NewFlagSet("esdump meta", pflag.ContinueOnError)
+
+	usage := func() {
+		fmt.Fprint(os.Stderr, `esdump meta base-url [name-patterns] [flags]
+
+Exports the metadata of the cluster to JSON files, to recreate it: the index
+templates, component templates, ILM policies, ingest pipelines and aliases.
+
+Each definition is written to its own file, in a directory per kind of
+metadata (e.g. ilm_policies/mypolicy.json), as the body of the request that
+re-applies it (e.g. PUT _ilm/policy/mypolicy). The aliases are re-applied with
+POST _aliases.
+
+Arguments:
+
+  base-url       The base URL of the Elasticsearch server (e.g. http://localhost)
+                 If the port is not specified, 9200 is assumed
+  name-patterns  Comma-separated list of patterns, with * wildcards, of the
+                 names of the definitions to export (default all)
+
+Examples:
+
+  esdump meta http://localhost
+  esdump meta http://localhost 'logs-*,metrics-*' --output-dir meta-backup
+
+Flags:
+
+`)
+		flags.PrintDefaults()
+	}
+	flags.Usage = usage
+
+	flags.StringVarP(&m.outputDir,
+		"output-dir", "o", "meta", "directory to write the files to")
+	flags.BoolVarP(&m.noCompression,
+		"no-compression", "z", false, "disable HTTP gzip compression")
+	flags.StringVar(&m.verify,
+		"verify", "", "certificate file to verify the server's certificate, or \"no\" to skip all TLS verification")
+	flags.DurationVar(&m.httpTimeout,
+		"http-timeout", time.Minute, "HTTP client timeout")
+	flags.SortFlags = false
+
+	err := flags.Parse(args)
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Error("parsing flags", "err", err)
+		usage()
+		os.Exit(1)
+	}
+
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		log.Error("one or two arguments expected")
+		usage()
+		os.Exit(1)
+	}
+	esURL, err := url.Parse(args[0])
+	if err != nil || esURL.Scheme == "" {
+		log.Error("first argument must be an URL")
+		usage()
+		os.Exit(1)
+	}
+	if len(args) == 2 {
+		m.patterns = strings.Split(args[1], ",")
+	}
+
+	if errs := m.validateFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		usage()
+		os.Exit(1)
+	}
+
+	m.setBaseURL(esURL)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	m.export(ctx)
+}
+
+func (m *metaDumper) validateFlags() []string {
+	var errs []string
+	for _, p := range m.patterns {
+		if _, err := path.Match(p, ""); p == "" || err != nil {
+			errs = append(errs, fmt.Sprintf("invalid name pattern %q", p))
+		}
+	}
+	if m.outputDir == "" {
+		errs = append(errs, "output-dir must not be empty")
+	}
+	if m.httpTimeout < 0 {
+		errs = append(errs, "http-timeout must be >= 0")
+	}
+	return errs
+}
+
+func (m *metaDumper) export(ctx context.Context) {
+	m.init()
+	m.server = m.getServerInfo(ctx)
+
+	var written, failed int
+	for _, kind := range metaKinds {
+		if kind.supported != nil && !kind.supported(m.server) {
+			log.Info("not supported by the server, skipping", "metadata", kind.dir)
+			continue
+		}
+		n, err := m.exportKind(ctx, kind)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Warn("export canceled before completion", "files", written)
+				return
+			}
+			log.Error("exporting metadata", "metadata", kind.dir, "err", err)
+			failed++
+		}
+		written += n
+	}
+
+	if failed > 0 {
+		log.Error("export failed for some metadata", "files", written, "failed", failed)
+		return
+	}
+	log.Info("export complete", "dir", m.outputDir, "files", written)
+}
+
+// exportKind writes the definitions of a kind of metadata that match the name
+// patterns, and returns the number of files written.
+func (m *metaDumper) exportKind(ctx context.Context, kind metaKind) (int, error) {
+	var resp json.RawMessage
+	status, raw, err := m.cl.Get(ctx, kind.endpoint, "", &resp)
+	if err != nil {
+		return 0, err
+	}
+	if status == http.StatusNotFound {
+		// e.g. there are no ingest pipelines at all
+		log.Info("exported", "metadata", kind.dir, "files", 0)
+		return 0, nil
+	}
+	if status != http.StatusOK {
+		return 0, newStatusError(status, raw)
+	}
+
+	defs, err := kind.parse(resp)
+	if err != nil {
+		return 0, fmt.Errorf("parsing response: %w", err)
+	}
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		if m.match(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		log.Info("exported", "metadata", kind.dir, "files", 0)
+		return 0, nil
+	}
+
+	dir := filepath.Join(m.outputDir, kind.dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	for i, name := range names {
+		b, err := json.MarshalIndent(defs[name], "", "    ")
+		if err != nil {
+			return i, err
+		}
+		file := filepath.Join(dir, url.PathEscape(name)+".json")
+		if err := os.WriteFile(file, append(b, '\n'), 0o644); err != nil {
+			return i, err
+		}
+	}
+	log.Info("exported", "metadata", kind.dir, "files", len(names),
+		"apply_with", strings.ReplaceAll(kind.apply, "{name}", "<name>"))
+	return len(names), nil
+}
+
+// match returns whether the name matches one of the patterns, or if there are
+// none.
+func (m *metaDumper) match(name string) bool {
+	if len(m.patterns) == 0 {
+		return true
+	}
+	for _, p := range m.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const parquetMagic = "PAR1"
+
+// uncompressed size above which the values of a column are written in a new
+// page
+const parquetPageSize = 1 << 20
+
+// Parquet physical types.
+const (
+	pqBoolean   = 0
+	pqInt32     = 1
+	pqInt64     = 2
+	pqFloat     = 4
+	pqDouble    = 5
+	pqByteArray = 6
+)
+
+// Parquet repetition types.
+const (
+	pqRequired = 0
+	pqOptional = 1
+	pqRepeated = 2
+)
+
+// Parquet converted types, the legacy annotations of the logical types.
+const (
+	pqNoConverted     = -1
+	pqUTF8            = 0
+	pqList            = 3
+	pqTimestampMillis = 9
+	pqUint64          = 14
+)
+
+const (
+	pqEncodingPlain = 0
+	pqEncodingRLE   = 3
+	pqDataPage      = 0
+)
+
+// Parquet compression codecs.
+var parquetCodecs = map[string]int32{
+	"none":   0,
+	"snappy": 1,
+	"gzip":   2,
+	"zstd":   6,
+}
+
+// pqKind is how the JSON values of a field are converted to Parquet values.
+type pqKind int
+
+const (
+	kindString pqKind = iota
+	kindBool
+	kindInt32
+	kindInt64
+	kindUint64
+	kindFloat
+	kindDouble
+	kindDateMillis
+	kindDateNanos
+)
+
+// pqNode is a field of the Parquet schema: either a group of fields, or a leaf
+// column.
+type pqNode struct {
+	name       string
+	repetition int32
+	converted  int32
+	children   []*pqNode
+
+	// repetition level of a repeated field
+	repLevel int
+
+	// leaf fields
+	kind     pqKind
+	physical int32
+	col      *pqColumn
+}
+
+func (n *pqNode) leaf() bool {
+	return n.children == nil
+}
+
+// clone returns a copy of the schema, of which the leaves can be bound to the
+// columns of another encoder.
+func (n *pqNode) clone() *pqNode {
+	c := *n
+	if n.children != nil {
+		c.children = make([]*pqNode, len(n.children))
+		for i, child := range n.children {
+			c.children[i] = child.clone()
+		}
+	}
+	return &c
+}
+
+// pqLeaf returns an optional column for a field of the given mapping type.
+// The types without a Parquet equivalent (geo_point, flattened...) are written
+// as strings, with their JSON value if they are not strings already.
+func pqLeaf(name, typ string) *pqNode {
+	n := &pqNode{name: name, repetition: pqOptional, converted: pqNoConverted}
+	switch typ {
+	case "boolean":
+		n.kind, n.physical = kindBool, pqBoolean
+	case "byte", "short", "integer":
+		n.kind, n.physical = kindInt32, pqInt32
+	case "long":
+		n.kind, n.physical = kindInt64, pqInt64
+	case "unsigned_long":
+		n.kind, n.physical, n.converted = kindUint64, pqInt64, pqUint64
+	case "float", "half_float":
+		n.kind, n.physical = kindFloat, pqFloat
+	case "double", "scaled_float":
+		n.kind, n.physical = kindDouble, pqDouble
+	case "date":
+		n.kind, n.physical, n.converted = kindDateMillis, pqInt64, pqTimestampMillis
+	case "date_nanos":
+		// there's no converted type for nanoseconds, only a logical type
+		n.kind, n.physical = kindDateNanos, pqInt64
+	default:
+		n.kind, n.physical, n.converted = kindString, pqByteArray, pqUTF8
+	}
+	return n
+}
+
+// isArrayField returns whether the field is one of the arrays given with
+// --parquet-arrays. Unlike with matchAny, the fields of an object that is an
+// array are not arrays themselves.
+func isArrayField(arrays []string, field string) bool {
+	for _, p := range arrays {
+		if ok, _ := path.Match(p, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pqListOf returns the 3-level list of the Parquet spec, of which each element
+// is the given field: a group or a leaf.
+func pqListOf(name string, element *pqNode) *pqNode {
+	element.name = "element"
+	element.repetition = pqOptional
+	list := &pqNode{name: "list", repetition: pqRepeated, converted: pqNoConverted, children: []*pqNode{element}}
+	return &pqNode{name: name, repetition: pqOptional, converted: pqList, children: []*pqNode{list}}
+}
+
+// initParquetSchema sets the schema of the Parquet output from the mappings of
+// the indices, restricted to the fields selected with --fields. Objects are
+// groups, and nested fields and the fields of --parquet-arrays are lists.
+func (d *dumper) initParquetSchema(ctx context.Context) {
+	var fields []*pqNode
+	if d.metadata || d.metadataOnly {
+		for _, c := range metadataColumns {
+			fields = append(fields, pqLeaf(c, "keyword"))
+		}
+	}
+	if !d.metadataOnly {
+		includes, excludes := sourceFilter(d.query["_source"])
+		var arrays []string
+		if d.parquetArrays != "" {
+			arrays = strings.Split(d.parquetArrays, ",")
+		}
+		fields = append(fields, pqFields(d.getMappings(ctx), "", includes, excludes, arrays)...)
+	}
+	if len(fields) == 0 {
+		log.Fatal("no field found in the mappings to use as columns, set them with --fields")
+	}
+	d.parquetSchema = &pqNode{name: "schema", repetition: pqRequired, converted: pqNoConverted, children: fields}
+}
+
+func pqFields(props map[string]mappingProperties, prefix string, includes, excludes, arrays []string) []*pqNode {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fields []*pqNode
+	for _, name := range names {
+		p := props[name]
+		path := prefix + name
+		switch {
+		case p.Properties != nil:
+			sub := pqFields(p.Properties, path+".", includes, excludes, arrays)
+			if len(sub) == 0 {
+				continue
+			}
+			group := &pqNode{name: name, repetition: pqOptional, converted: pqNoConverted, children: sub}
+			if p.Type == "nested" || isArrayField(arrays, path) {
+				group = pqListOf(name, group)
+			}
+			fields = append(fields, group)
+		case p.Type == "alias":
+			// aliases are not in the _source
+		case (len(includes) == 0 || matchAny(includes, path)) && !matchAny(excludes, path):
+			leaf := pqLeaf(name, p.Type)
+			if isArrayField(arrays, path) {
+				leaf = pqListOf(name, leaf)
+			}
+			fields = append(fields, leaf)
+		}
+	}
+	return fields
+}
+
+// pqColumn buffers the values of a leaf column, along with their repetition
+// and definition levels, until they are written as pages of a column chunk.
+type pqColumn struct {
+	node   *pqNode
+	path   []string
+	maxRep int
+	maxDef int
+
+	// current page
+	reps      []int
+	defs      []int
+	values    bytes.Buffer
+	bools     []bool
+	numValues int
+
+	// current column chunk
+	chunk            bytes.Buffer
+	chunkValues      int64
+	uncompressedSize int64
+}
+
+func (c *pqColumn) add(rep, def int) {
+	c.reps = append(c.reps, rep)
+	c.defs = append(c.defs, def)
+	c.numValues++
+}
+
+// writePage encodes the buffered values as a data page, appended to the
+// column chunk.
+func (c *pqColumn) writePage(codec int32) error {
+	var body bytes.Buffer
+	if c.maxRep > 0 {
+		writeLevels(&body, c.reps, c.maxRep)
+	}
+	if c.maxDef > 0 {
+		writeLevels(&body, c.defs, c.maxDef)
+	}
+	if len(c.bools) > 0 {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, b := range c.bools {
+			if b {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		body.Write(packed)
+	}
+	body.Write(c.values.Bytes())
+
+	data, err := compress(codec, body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var h thriftWriter
+	h.beginStruct()
+	h.i32Field(1, pqDataPage)
+	h.i32Field(2, int32(body.Len()))
+	h.i32Field(3, int32(len(data)))
+	h.structField(5)
+	h.i32Field(1, int32(c.numValues))
+	h.i32Field(2, pqEncodingPlain)
+	h.i32Field(3, pqEncodingRLE)
+	h.i32Field(4, pqEncodingRLE)
+	h.endStruct()
+	h.endStruct()
+
+	c.uncompressedSize += int64(h.buf.Len() + body.Len())
+	c.chunk.Write(h.buf.Bytes())
+	c.chunk.Write(data)
+	c.chunkValues += int64(c.numValues)
+
+	c.reps = c.reps[:0]
+	c.defs = c.defs[:0]
+	c.values.Reset()
+	c.bools = c.bools[:0]
+	c.numValues = 0
+	return nil
+}
+
+// writeLevels writes the levels with the RLE encoding, prefixed by their
+// length.
+func writeLevels(buf *bytes.Buffer, levels []int, max int) {
+	width := (bits.Len(uint(max)) + 7) / 8
+	var runs bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		n := binary.PutUvarint(varint[:], uint64(j-i)<<1)
+		runs.Write(varint[:n])
+		for b := 0; b < width; b++ {
+			runs.WriteByte(byte(levels[i] >> (8 * b)))
+		}
+		i = j
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(runs.Len()))
+	buf.Write(length[:])
+	buf.Write(runs.Bytes())
+}
+
+// zstdEncoder compresses the pages, it is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func compress(codec int32, data []byte) ([]byte, error) {
+	switch codec {
+	case parquetCodecs["snappy"]:
+		return snappy.Encode(nil, data), nil
+	case parquetCodecs["gzip"]:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case parquetCodecs["zstd"]:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+type pqChunkMeta struct {
+	col              *pqColumn
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type pqRowGroup struct {
+	chunks  []pqChunkMeta
+	numRows int64
+}
+
+// parquetEncoder writes the hits as the rows of a Parquet file. The rows are
+// buffered in memory until a row group is complete, and the file metadata is
+// written when the encoder is closed.
+type parquetEncoder struct {
+	w            *bufio.Writer
+	schema       *pqNode
+	columns      []*pqColumn
+	codec        int32
+	rowGroupSize int
+	metadata     bool
+
+	offset    int64
+	rows      int
+	rowGroups []pqRowGroup
+	warned    map[string]bool
+}
+
+func (d *dumper) newParquetEncoder(w *bufio.Writer) (*parquetEncoder, error) {
+	e := &parquetEncoder{
+		w:            w,
+		schema:       d.parquetSchema.clone(),
+		codec:        parquetCodecs[d.parquetCompression],
+		rowGroupSize: d.rowGroupSize,
+		metadata:     d.metadata || d.metadataOnly,
+		warned:       make(map[string]bool),
+	}
+	e.initColumns(e.schema, nil, 0, 0)
+	if _, err := w.WriteString(parquetMagic); err != nil {
+		return nil, err
+	}
+	e.offset = int64(len(parquetMagic))
+	return e, nil
+}
+
+func (e *parquetEncoder) initColumns(n *pqNode, path []string, rep, def int) {
+	for _, c := range n.children {
+		p := append(append([]string{}, path...), c.name)
+		r, d := rep, def
+		switch c.repetition {
+		case pqOptional:
+			d++
+		case pqRepeated:
+			r++
+			d++
+			c.repLevel = r
+		}
+		if c.leaf() {
+			c.col = &pqColumn{node: c, path: p, maxRep: r, maxDef: d}
+			e.columns = append(e.columns, c.col)
+			continue
+		}
+		e.initColumns(c, p, r, d)
+	}
+}
+
+func (e *parquetEncoder) encode(h hit) error {
+	var doc map[string]any
+	if err := numberJSON.Unmarshal(h.doc, &doc); err != nil {
+		return fmt.Errorf("parsing hit: %w", err)
+	}
+
+	record := doc
+	if e.metadata {
+		record, _ = doc["_source"].(map[string]any)
+		if record == nil {
+			record = make(map[string]any)
+		}
+		for _, c := range metadataColumns {
+			record[c] = doc[c]
+		}
+	}
+	for _, c := range e.schema.children {
+		if err := e.shred(c, record[c.name], c.name, 0, 0); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range e.columns {
+		if c.values.Len()+len(c.bools)/8 >= parquetPageSize {
+			if err := c.writePage(e.codec); err != nil {
+				return err
+			}
+		}
+	}
+	e.rows++
+	if e.rows >= e.rowGroupSize {
+		return e.writeRowGroup()
+	}
+	return nil
+}
+
+// shred adds the value of a field to the columns of its leaves, with the
+// repetition level rep and the definition level def of its parent.
+func (e *parquetEncoder) shred(n *pqNode, v any, path string, rep, def int) error {
+	if arr, ok := v.([]any); ok && n.converted != pqList {
+		// a single value may be in an array, but several values can only be
+		// written in a list
+		if len(arr) > 1 {
+			return fmt.Errorf("field %s has an array of values, add it to --parquet-arrays to write it as a list", path)
+		}
+		v = nil
+		if len(arr) > 0 {
+			v = arr[0]
+		}
+	}
+
+	if v == nil {
+		e.shredNull(n, rep, def)
+		return nil
+	}
+
+	switch {
+	case n.leaf():
+		e.addValue(n, v, path, rep, def+1)
+	case n.converted == pqList:
+		arr, ok := v.([]any)
+		if !ok {
+			arr = []any{v}
+		}
+		list := n.children[0]
+		if len(arr) == 0 {
+			e.shredNull(list, rep, def+1)
+			return nil
+		}
+		for i, elem := range arr {
+			if i > 0 {
+				rep = list.repLevel
+			}
+			if err := e.shred(list.children[0], elem, path, rep, def+2); err != nil {
+				return err
+			}
+		}
+	default:
+		m, ok := v.(map[string]any)
+		if !ok {
+			e.warnOnce(path, "field is not an object, it is ignored")
+			e.shredNull(n, rep, def)
+			return nil
+		}
+		for _, c := range n.children {
+			if err := e.shred(c, m[c.name], path+"."+c.name, rep, def+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shredNull adds a null value to all the leaves of the field.
+func (e *parquetEncoder) shredNull(n *pqNode, rep, def int) {
+	if n.leaf() {
+		n.col.add(rep, def)
+		return
+	}
+	for _, c := range n.children {
+		e.shredNull(c, rep, def)
+	}
+}
+
+func (e *parquetEncoder) addValue(n *pqNode, v any, path string, rep, def int) {
+	c := n.col
+	var err error
+	switch n.kind {
+	case kindString:
+		var s string
+		s, err = pqString(v)
+		if err == nil {
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], uint32(len(s)))
+			c.values.Write(length[:])
+			c.values.WriteString(s)
+		}
+	case kindBool:
+		var b bool
+		b, err = pqBool(v)
+		if err == nil {
+			c.bools = append(c.bools, b)
+		}
+	case kindInt32:
+		var i int64
+		i, err = pqInt(v)
+		if err == nil && (i < math.MinInt32 || i > math.MaxInt32) {
+			err = fmt.Errorf("value %d out of range", i)
+		}
+		if err == nil {
+			err = binary.Write(&c.values, binary.LittleEndian, int32(i))
+		}
+	case kindInt64:
+		var i int64
+		i, err = pqInt(v)
+		if err == nil {
+			err = binary.Write(&c.values, binary.LittleEndian, i)
+		}
+	case kindUint64:
+		var u uint64
+		u, err = strconv.ParseUint(fmt.Sprint(v), 10, 64)
+		if err == nil {
+			err = binary.Write(&c.values, binary.LittleEndian, u)
+		}
+	case kindFloat:
+		var f float64
+		f, err = pqFloat64(v)
+		if err == nil {
+			err = binary.Write(&c.values, binary.LittleEndian, float32(f))
+		}
+	case kindDouble:
+		var f float64
+		f, err = pqFloat64(v)
+		if err == nil {
+			err = binary.Write(&c.values, binary.LittleEndian, f)
+		}
+	case kindDateMillis, kindDateNanos:
+		var t int64
+		t, err = pqTimestamp(v, n.kind == kindDateNanos)
+		if err == nil {
+			err = binary.Write(&c.values, binary.LittleEndian, t)
+		}
+	}
+	if err != nil {
+		e.warnOnce(path, "value cannot be converted to the type of the column, it is written as null", "value", v, "err", err)
+		def--
+	}
+	c.add(rep, def)
+}
+
+func (e *parquetEncoder) warnOnce(path, msg string, keyvals ...any) {
+	if e.warned[path] {
+		return
+	}
+	e.warned[path] = true
+	log.Warn(msg, append([]any{"field", path}, keyvals...)...)
+}
+
+func pqString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return string(v), nil
+	default:
+		b, err := numberJSON.Marshal(v)
+		return string(b), err
+	}
+}
+
+func pqBool(v any) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, fmt.Errorf("not a boolean")
+}
+
+func pqInt(v any) (int64, error) {
+	s, ok := pqNumber(v)
+	if !ok {
+		return 0, fmt.Errorf("not a number")
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Elasticsearch truncates the decimals of integer fields
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, err
+		}
+		return int64(f), nil
+	}
+	return i, nil
+}
+
+func pqFloat64(v any) (float64, error) {
+	s, ok := pqNumber(v)
+	if !ok {
+		return 0, fmt.Errorf("not a number")
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// pqNumber returns the number as a string; numeric strings are accepted, as
+// they are by Elasticsearch.
+func pqNumber(v any) (string, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return string(v), true
+	case string:
+		return strings.TrimSpace(v), true
+	}
+	return "", false
+}
+
+// date formats of the string values of date fields, in addition to epoch
+// milliseconds
+var pqDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// pqTimestamp returns the timestamp of a date value, in milliseconds or
+// nanoseconds since the epoch.
+func pqTimestamp(v any, nanos bool) (int64, error) {
+	if n, ok := v.(json.Number); ok {
+		ms, err := n.Float64()
+		if err != nil {
+			return 0, err
+		}
+		if nanos {
+			return int64(ms * 1e6), nil
+		}
+		return int64(ms), nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("not a date")
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return pqTimestamp(json.Number(s), nanos)
+	}
+	for _, layout := range pqDateLayouts {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		if nanos {
+			return t.UnixNano(), nil
+		}
+		return t.UnixMilli(), nil
+	}
+	return 0, fmt.Errorf("unknown date format")
+}
+
+// writeRowGroup writes the buffered rows as a row group.
+func (e *parquetEncoder) writeRowGroup() error {
+	if e.rows == 0 {
+		return nil
+	}
+	rg := pqRowGroup{numRows: int64(e.rows)}
+	for _, c := range e.columns {
+		if c.numValues > 0 {
+			if err := c.writePage(e.codec); err != nil {
+				return err
+			}
+		}
+		n, err := e.w.Write(c.chunk.Bytes())
+		if err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, pqChunkMeta{
+			col:              c,
+			offset:           e.offset,
+			numValues:        c.chunkValues,
+			uncompressedSize: c.uncompressedSize,
+			compressedSize:   int64(n),
+		})
+		e.offset += int64(n)
+
+		c.chunk.Reset()
+		c.chunkValues = 0
+		c.uncompressedSize = 0
+	}
+	e.rowGroups = append(e.rowGroups, rg)
+	e.rows = 0
+	return nil
+}
+
+func (e *parquetEncoder) flush() error {
+	return nil
+}
+
+// close writes the last row group and the file metadata.
+func (e *parquetEncoder) close() error {
+	if err := e.writeRowGroup(); err != nil {
+		return err
+	}
+
+	var totalRows int64
+	for _, rg := range e.rowGroups {
+		totalRows += rg.numRows
+	}
+
+	var w thriftWriter
+	w.beginStruct()
+	w.i32Field(1, 1)
+	var schema []*pqNode
+	flattenSchema(e.schema, &schema)
+	w.listField(2, thriftStruct, len(schema))
+	for _, n := range schema {
+		writeSchemaElement(&w, n)
+	}
+	w.i64Field(3, totalRows)
+	w.listField(4, thriftStruct, len(e.rowGroups))
+	for _, rg := range e.rowGroups {
+		e.writeRowGroupMeta(&w, rg)
+	}
+	w.stringField(6, "esdump")
+	w.endStruct()
+
+	if _, err := e.w.Write(w.buf.Bytes()); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(w.buf.Len()))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.WriteString(parquetMagic)
+	return err
+}
+
+// flattenSchema lists the nodes of the schema depth-first, as they are
+// written in the file metadata.
+func flattenSchema(n *pqNode, nodes *[]*pqNode) {
+	*nodes = append(*nodes, n)
+	for _, c := range n.children {
+		flattenSchema(c, nodes)
+	}
+}
+
+func writeSchemaElement(w *thriftWriter, n *pqNode) {
+	w.beginStruct()
+	if n.leaf() {
+		w.i32Field(1, n.physical)
+	}
+	w.i32Field(3, n.repetition)
+	w.stringField(4, n.name)
+	if !n.leaf() {
+		w.i32Field(5, int32(len(n.children)))
+	}
+	if n.converted != pqNoConverted {
+		w.i32Field(6, n.converted)
+	}
+	if n.leaf() && (n.kind == kindDateMillis || n.kind == kindDateNanos) {
+		// logical type TIMESTAMP, adjusted to UTC
+		unit := int16(1)
+		if n.kind == kindDateNanos {
+			unit = 3
+		}
+		w.structField(10)
+		w.structField(8)
+		w.boolField(1, true)
+		w.structField(2)
+		w.structField(unit)
+		w.endStruct()
+		w.endStruct()
+		w.endStruct()
+		w.endStruct()
+	}
+	w.endStruct()
+}
+
+func (e *parquetEncoder) writeRowGroupMeta(w *thriftWriter, rg pqRowGroup) {
+	w.beginStruct()
+	w.listField(1, thriftStruct, len(rg.chunks))
+	var totalSize int64
+	for _, ch := range rg.chunks {
+		totalSize += ch.uncompressedSize
+
+		w.beginStruct()
+		w.i64Field(2, ch.offset)
+		w.structField(3)
+		w.i32Field(1, ch.col.node.physical)
+		w.listField(2, thriftI32, 2)
+		w.zigzag(pqEncodingPlain)
+		w.zigzag(pqEncodingRLE)
+		w.listField(3, thriftBinary, len(ch.col.path))
+		for _, p := range ch.col.path {
+			w.binary([]byte(p))
+		}
+		w.i32Field(4, e.codec)
+		w.i64Field(5, ch.numValues)
+		w.i64Field(6, ch.uncompressedSize)
+		w.i64Field(7, ch.compressedSize)
+		w.i64Field(9, ch.offset)
+		w.endStruct()
+		w.endStruct()
+	}
+	w.i64Field(2, totalSize)
+	w.i64Field(3, rg.numRows)
+	w.endStruct()
+}
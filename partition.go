@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+type aggValue struct {
+	Value         *float64 `json:"value"`
+	ValueAsString string   `json:"value_as_string"`
+}
+
+type fieldRangeResp struct {
+	Aggregations struct {
+		Min         aggValue `json:"min"`
+		Max         aggValue `json:"max"`
+		Percentiles struct {
+			Values map[string]*float64 `json:"values"`
+		} `json:"percentiles"`
+	} `json:"aggregations"`
+}
+
+// partitionSlices splits the range of values of the partition field into
+// bounded range queries, each scrolled independently over the whole target,
+// instead of using the slice parameter, which can be very slow on the server
+// when there are more slices than shards.
+func (d *dumper) partitionSlices(ctx context.Context) []slice {
+	aggs := obj{
+		"min": obj{"min": obj{"field": d.partitionField}},
+		"max": obj{"max": obj{"field": d.partitionField}},
+	}
+	if d.partitionPercentiles {
+		var percents []float64
+		for i := 1; i < d.partitions; i++ {
+			percents = append(percents, 100*float64(i)/float64(d.partitions))
+		}
+		aggs["percentiles"] = obj{
+			"percentiles": obj{
+				"field":    d.partitionField,
+				"percents": percents,
+			},
+		}
+	}
+	body, err := json.Marshal(obj{
+		"size":  0,
+		"query": d.query["query"],
+		"aggs":  aggs,
+	})
+	if err != nil {
+		log.Fatal("marshaling partition range query", "err", err)
+	}
+
+	var resp fieldRangeResp
+	status, raw, err := d.cl.Get(ctx, d.target+"/_search", string(body), &resp)
+	if err != nil {
+		log.Fatal("getting the range of the partition field", "err", err)
+	}
+	if status != http.StatusOK {
+		log.Fatal("getting the range of the partition field, got unexpected status code", "code", status, "response", string(raw))
+	}
+
+	lo, hi := resp.Aggregations.Min, resp.Aggregations.Max
+	if lo.Value == nil || hi.Value == nil {
+		log.Fatal("no document has a value for the partition field", "field", d.partitionField)
+	}
+	// only date fields have a string representation of their values
+	isDate := lo.ValueAsString != ""
+
+	var cuts []float64
+	if d.partitionPercentiles {
+		for _, v := range resp.Aggregations.Percentiles.Values {
+			if v != nil {
+				cuts = append(cuts, *v)
+			}
+		}
+	} else {
+		step := (*hi.Value - *lo.Value) / float64(d.partitions)
+		for i := 1; i < d.partitions; i++ {
+			cuts = append(cuts, *lo.Value+float64(i)*step)
+		}
+	}
+	// the values of the aggregations are doubles, even for long fields, which
+	// may not be exact: the cut points of fields whose values seem to be
+	// integers are rounded to integers, and the first and last partitions are
+	// unbounded, so as to include the min and max whatever their precision
+	integer := isDate || *lo.Value == math.Trunc(*lo.Value) && *hi.Value == math.Trunc(*hi.Value)
+	bounds := cutPoints(cuts, integer)
+
+	log.Info("dumping with partitions", "field", d.partitionField, "min", rangeValueString(lo), "max", rangeValueString(hi),
+		"partitions", len(bounds)+1)
+
+	var slices []slice
+	for i := 0; i <= len(bounds); i++ {
+		rng := obj{}
+		if i > 0 {
+			rng["gte"] = bounds[i-1]
+		}
+		if i < len(bounds) {
+			rng["lt"] = bounds[i]
+		}
+		filter := obj{"range": obj{d.partitionField: rng}}
+		if len(rng) == 0 {
+			// all the documents have the same value
+			filter = obj{"exists": obj{"field": d.partitionField}}
+		} else if isDate {
+			rng["format"] = "epoch_millis"
+		}
+		slices = append(slices, slice{
+			key:    fmt.Sprintf("partition/%d", i),
+			index:  d.target,
+			filter: filter,
+		})
+	}
+
+	// the documents that don't have a value for the field would not be in any
+	// range, so they get their own partition
+	slices = append(slices, slice{
+		key:   "partition/missing",
+		index: d.target,
+		filter: obj{
+			"bool": obj{
+				"must_not": obj{"exists": obj{"field": d.partitionField}},
+			},
+		},
+	})
+	return slices
+}
+
+// cutPoints sorts the values between the partitions and removes duplicates.
+// For integer and date fields, they are rounded down to integers (whole
+// milliseconds for dates), which unlike doubles are exact for all longs.
+func cutPoints(cuts []float64, integer bool) []json.Number {
+	sort.Float64s(cuts)
+	var points []json.Number
+	for _, c := range cuts {
+		p := json.Number(strconv.FormatFloat(c, 'g', -1, 64))
+		if integer {
+			p = json.Number(strconv.FormatInt(floorInt64(c), 10))
+		}
+		if len(points) == 0 || p != points[len(points)-1] {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// floorInt64 rounds down the value to an integer, within the range of longs.
+func floorInt64(f float64) int64 {
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(math.Floor(f))
+}
+
+func rangeValueString(v aggValue) string {
+	if v.ValueAsString != "" {
+		return v.ValueAsString
+	}
+	return fmt.Sprint(*v.Value)
+}
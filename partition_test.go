@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestCutPoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		cuts    []float64
+		integer bool
+		want    []json.Number
+	}{
+		{
+			name: "floats",
+			cuts: []float64{2.5, 0.25, 2.5},
+			want: []json.Number{"0.25", "2.5"},
+		},
+		{
+			name:    "integers rounded down and deduplicated",
+			cuts:    []float64{10.9, 3.2, 10.1},
+			integer: true,
+			want:    []json.Number{"3", "10"},
+		},
+		{
+			// the doubles of large longs are not exact, but the cut points
+			// must be valid longs
+			name:    "large longs",
+			cuts:    []float64{9007199254740993, 9.3e18, -9.3e18},
+			integer: true,
+			want:    []json.Number{"-9223372036854775808", "9007199254740992", "9223372036854775807"},
+		},
+		{
+			name: "none",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cutPoints(tt.cuts, tt.integer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+type openPITResp struct {
+	// Elasticsearch
+	ID string `json:"id"`
+	// OpenSearch
+	PitID string `json:"pit_id"`
+}
+
+// openPIT opens a point-in-time over the given index target. When dumping with
+// --pit, it is opened over the whole target, so that all the slices of all
+// the indices see the same consistent snapshot.
+func (d *dumper) openPIT(ctx context.Context, target string) (string, error) {
+	path := target + "/_pit?keep_alive=" + d.scrollTimeoutES
+	if d.server.isOpenSearch() {
+		path = target + "/_search/point_in_time?keep_alive=" + d.scrollTimeoutES
+	}
+
+	var resp openPITResp
+	status, raw, err := d.cl.Post(ctx, path, "", &resp)
+	if err != nil {
+		return "", fmt.Errorf("opening point-in-time: %w", err)
+	}
+	if status != http.StatusOK {
+		log.Error("opening point-in-time, got unexpected status code", "code", status, "response", string(raw))
+		return "", newStatusError(status, raw)
+	}
+	pitID := resp.ID
+	if pitID == "" {
+		pitID = resp.PitID
+	}
+	if pitID == "" {
+		return "", errors.New("opening point-in-time: got empty id")
+	}
+	return pitID, nil
+}
+
+func (d *dumper) closePIT(pitID string) {
+	if pitID == "" {
+		return
+	}
+	// same as for the scroll contexts, we want to close the PIT even after the
+	// Go ctx is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	path := "_pit"
+	var req any = map[string]string{"id": pitID}
+	if d.server.isOpenSearch() {
+		path = "_search/point_in_time"
+		req = map[string][]string{"pit_id": {pitID}}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Error("closing point-in-time", "err", err)
+		return
+	}
+	status, raw, err := d.cl.Delete(ctx, path, string(body), nil)
+	if err != nil {
+		log.Error("closing point-in-time", "err", err)
+		return
+	}
+	if status != http.StatusOK {
+		log.Error("closing point-in-time", "code", status, "response", string(raw))
+	}
+}
+
+// pitSlices splits the point-in-time into slices. As the PIT spans all the
+// indices, the slices are shared between them.
+func (d *dumper) pitSlices(indexShards map[string]int) []slice {
+	var shards int
+	for _, idxShards := range indexShards {
+		shards += idxShards
+	}
+
+	n := d.slices
+	if n > shards {
+		n = shards
+	}
+
+	log.Info("dumping with point-in-time", "indices", len(indexShards), "shards", shards, "slices", n)
+	slices := make([]slice, n)
+	for i := range slices {
+		slices[i] = slice{
+			key: strconv.Itoa(i),
+			id:  i,
+			max: n,
+		}
+	}
+	return slices
+}
+
+// pitSlice is the point-in-time equivalent of scrollSlice: instead of
+// following a scroll context, it pages through the PIT with search_after. It
+// starts from the given state when resuming from a checkpoint.
+func (d *dumper) pitSlice(ctx context.Context, s slice, state sliceCheckpoint) error {
+	if state.Done {
+		d.totalHitsCtr.Report(state.Written)
+		return nil
+	}
+
+	q := d.sliceQuery(s)
+	if state.SearchAfter != nil {
+		q["search_after"] = state.SearchAfter
+	}
+	ps := &pageSize{n: d.size}
+	return d.pitPages(ctx, s.key, ps, q, d.pitID, d.totalHitsCtr.Report)
+}
+
+// pitPages pages through a point-in-time with search_after, starting with the
+// given query, until the end of the slice. The total number of hits of the
+// first response is passed to reportTotal.
+func (d *dumper) pitPages(ctx context.Context, sliceKey string, ps *pageSize, q obj, pitID string, reportTotal func(uint64)) error {
+	reqStart := time.Now()
+	resp, more, err := d.pitRequest(ctx, sliceKey, ps, q, pitID)
+	if resp != nil {
+		reportTotal(resp.GetTotal())
+	} else {
+		reportTotal(0)
+	}
+	if err != nil || !more {
+		return err
+	}
+
+	for {
+		cancelableSleep(ctx, d.throttlingDuration(time.Since(reqStart)))
+		// the PIT id may change between requests, the most recent one must
+		// always be used
+		if newPitID := resp.GetPitID(); newPitID != "" {
+			pitID = newPitID
+		}
+		searchAfter := resp.GetLastSort()
+		if searchAfter == nil {
+			return errors.New("missing sort values in hits, cannot paginate with search_after")
+		}
+		q["search_after"] = searchAfter
+
+		reqStart = time.Now()
+		resp, more, err = d.pitRequest(ctx, sliceKey, ps, q, pitID)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func (d *dumper) pitRequest(ctx context.Context, sliceKey string, ps *pageSize, q obj, pitID string) (scrollResp, bool, error) {
+	q["pit"] = obj{
+		"id":         pitID,
+		"keep_alive": d.scrollTimeoutES,
+	}
+	return d.scrollRequest(ctx, sliceKey, "_search", ps, nil, func() string {
+		q["size"] = ps.n
+		qBytes, err := json.Marshal(q)
+		if err != nil {
+			log.Fatal("marshaling search request", "err", err)
+		}
+		return string(qBytes)
+	})
+}
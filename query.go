@@ -52,11 +52,32 @@ func (d *dumper) createQuery() {
 	if d.metadataOnly {
 		q["_source"] = false
 	}
-	if _, ok := q["size"]; !ok {
-		q["size"] = d.size
+	if size, ok := q["size"].(float64); ok {
+		// the page size must be known to detect the last page of each slice
+		d.size = int(size)
+		if d.size < 1 {
+			log.Fatal("size of the query must be >= 1", "size", size)
+		}
 	}
+	q["size"] = d.size
 	if _, ok := q["sort"]; !ok {
-		q["sort"] = []string{"_doc"}
+		var sort []any
+		if d.follow {
+			// output the new documents in chronological order
+			sort = append(sort, obj{d.followField: "asc"})
+		}
+		switch {
+		case !d.pit:
+			sort = append(sort, "_doc")
+		case d.server.supportsShardDoc():
+			// _shard_doc is the PIT equivalent of _doc: the most efficient
+			// order, and a unique tiebreaker usable with search_after
+			sort = append(sort, "_shard_doc")
+		default:
+			log.Fatal("this server doesn't support the _shard_doc tiebreaker (Elasticsearch 7.12 or later), "+
+				"with --pit a sort on fields with unique values must be supplied on stdin", "server", d.server)
+		}
+		q["sort"] = sort
 	}
 	if _, ok := q["query"]; !ok {
 		if d.queryString != "" {
@@ -71,15 +92,34 @@ func (d *dumper) createQuery() {
 			}
 		}
 	}
-	if d.random {
+	if d.sample > 0 {
+		d.clientSample = needsClientSample(q, d.random)
+	}
+	if d.random || d.sample > 0 && !d.clientSample {
+		randomScore := obj{}
+		if d.seeded {
+			log.Info("random score with seed", "seed", d.seed, "field", d.seedField)
+			randomScore["seed"] = d.seed
+			randomScore["field"] = d.seedField
+		}
 		q["query"] = obj{
 			"function_score": obj{
 				"query":        q["query"],
-				"random_score": obj{},
+				"random_score": randomScore,
 				"boost_mode":   "replace",
 			},
 		}
+	}
+	if d.random {
 		q["sort"] = []string{"_score"}
+		if d.seeded {
+			// the tiebreaker of the merge of the slices
+			q["sort"] = []string{"_score", "_seq_no"}
+		}
+	}
+	if d.sample > 0 && !d.clientSample {
+		// random scores are uniformly distributed in [0, 1)
+		q["min_score"] = 1 - d.sample
 	}
 	d.query = q
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+// pageSize is the number of hits per page requested by a slice. It is reduced
+// when the cluster trips a circuit breaker, but only until the scroll context
+// is opened, as the page size of a scroll is then fixed.
+type pageSize struct {
+	n      int
+	frozen bool
+}
+
+func (ps *pageSize) shrink() bool {
+	if ps.frozen || ps.n <= 1 {
+		return false
+	}
+	ps.n /= 2
+	return true
+}
+
+// searchWithRetry sends a search or scroll request, retrying with a jittered
+// exponential backoff on transient failures. The body is rebuilt for each
+// attempt, as the page size may have been reduced in the meantime.
+func (d *dumper) searchWithRetry(ctx context.Context, sliceKey, path string, ps *pageSize, body func() string, dst any) error {
+	for attempt := 0; ; attempt++ {
+		status, raw, err := d.cl.Get(ctx, path, body(), dst)
+		if err == nil && status == http.StatusOK {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var reason string
+		var retryable bool
+		if err != nil {
+			reason = err.Error()
+			retryable = isRetryableError(err)
+		} else {
+			reason = fmt.Sprintf("status code %d", status)
+			retryable = isRetryableStatus(status)
+			if strings.Contains(string(raw), "circuit_breaking_exception") {
+				reason = "circuit breaking exception"
+				retryable = true
+				if ps.shrink() {
+					log.Warn("circuit breaker tripped, reducing page size", "slice", sliceKey, "size", ps.n)
+				}
+			}
+		}
+
+		if !retryable || attempt >= d.retries {
+			if err != nil {
+				log.Error("sending scroll request", "slice", sliceKey, "err", err)
+				return err
+			}
+			statusErr := newStatusError(status, raw)
+			// an expired context is handled by the caller, it is not
+			// necessarily an error
+			if !isSearchContextMissing(statusErr) {
+				log.Error("got unexpected status code", "slice", sliceKey, "code", status, "response", string(raw))
+			}
+			return statusErr
+		}
+
+		delay := d.retryBackoff(attempt)
+		atomic.AddUint64(&d.retried, 1)
+		log.Warn("request failed, retrying", "slice", sliceKey, "reason", reason,
+			"attempt", fmt.Sprintf("%d/%d", attempt+1, d.retries), "backoff", delay.Round(time.Millisecond))
+		cancelableSleep(ctx, delay)
+	}
+}
+
+// retryBackoff returns the delay before the given retry attempt (starting at
+// 0), with "equal jitter", i.e. between half and all of the exponential delay.
+func (d *dumper) retryBackoff(attempt int) time.Duration {
+	if d.retryBackoffBase <= 0 {
+		return 0
+	}
+	delay := d.retryBackoffBase << attempt
+	// a non-positive delay is an overflow of the shift
+	if delay <= 0 || delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	// as with throttling, make sure we don't get too close to the scroll
+	// context timeout
+	if maxDelay := 3 * d.scrollTimeout / 4; d.scrollTimeout > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// isSearchContextMissing returns whether the error is due to the scroll
+// context (or point-in-time) having expired.
+func isSearchContextMissing(err error) bool {
+	var statusErr *statusError
+	return errors.As(err, &statusErr) &&
+		statusErr.status == http.StatusNotFound &&
+		strings.Contains(statusErr.body, "search_context_missing_exception")
+}
+
+// statusError is returned when Elasticsearch answers with an unexpected status
+// code.
+type statusError struct {
+	status int
+	body   string
+}
+
+func newStatusError(status int, raw []byte) *statusError {
+	return &statusError{
+		status: status,
+		body:   string(raw),
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.status)
+}
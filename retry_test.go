@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	d := dumper{}
+	if delay := d.retryBackoff(3); delay != 0 {
+		t.Errorf("without backoff: got %v, want 0", delay)
+	}
+
+	d.retryBackoffBase = time.Second
+	if delay := d.retryBackoff(1); delay < time.Second || delay > 2*time.Second {
+		t.Errorf("second retry: got %v, want between 1s and 2s", delay)
+	}
+	// the shift overflows
+	if delay := d.retryBackoff(70); delay < maxRetryBackoff/2 || delay > maxRetryBackoff {
+		t.Errorf("after many retries: got %v, want at most %v", delay, maxRetryBackoff)
+	}
+}
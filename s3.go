@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	s3Scheme          = "s3://"
+	s3DefaultEndpoint = "https://s3.amazonaws.com"
+	// limits of the multipart uploads
+	s3MinPartSize = 5 << 20
+	s3MaxParts    = 10000
+)
+
+func isS3Path(path string) bool {
+	return strings.HasPrefix(path, s3Scheme)
+}
+
+// splitS3Path splits s3://bucket/key into its bucket and key.
+func splitS3Path(path string) (bucket, key string) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(path, s3Scheme), "/")
+	return bucket, key
+}
+
+// joinOutputPath joins the name of a file to the output directory, which may
+// be an S3 prefix.
+func joinOutputPath(dir, name string) string {
+	if isS3Path(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + name
+	}
+	return filepath.Join(dir, name)
+}
+
+func (d *dumper) s3Output() bool {
+	return isS3Path(d.output) || isS3Path(d.outputDir) || isS3Path(d.outputTemplate) || isS3Path(d.archive) || isS3Path(d.deadLetter)
+}
+
+// initS3 creates the S3 client. The credentials are taken from the
+// environment (AWS_ACCESS_KEY_ID... or MINIO_ACCESS_KEY...), then from the
+// AWS or MinIO client configuration files, then from the IAM role.
+func (d *dumper) initS3() {
+	endpoint := d.s3Endpoint
+	for _, env := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if endpoint == "" {
+			endpoint = os.Getenv(env)
+		}
+	}
+	if endpoint == "" {
+		endpoint = s3DefaultEndpoint
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		log.Fatal("parsing S3 endpoint", "err", err)
+	}
+
+	region := d.s3Region
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(env)
+		}
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.FileMinioClient{},
+		&credentials.IAM{},
+	})
+	d.s3, err = minio.NewCore(u.Host, &minio.Options{
+		Creds:  creds,
+		Secure: u.Scheme == "https",
+		Region: region,
+		// the parts are retried by esdump, with the same backoff as the
+		// requests to Elasticsearch
+		MaxRetries: 1,
+	})
+	if err != nil {
+		log.Fatal("creating S3 client", "err", err)
+	}
+	log.Info("writing output to S3", "endpoint", u.Host, "region", region)
+}
+
+// s3Upload is an output file uploaded to S3 as a multipart upload, one part
+// at a time as the output is written. The upload is only completed at the end
+// of the dump, if it succeeded, so that a partial dump is never mistaken for a
+// complete one.
+type s3Upload struct {
+	d        *dumper
+	path     string
+	bucket   string
+	key      string
+	uploadID string
+	buf      []byte
+	parts    []minio.CompletePart
+	size     int64
+}
+
+func (d *dumper) newS3Upload(path string) *s3Upload {
+	bucket, key := splitS3Path(path)
+	u := &s3Upload{
+		d:      d,
+		path:   path,
+		bucket: bucket,
+		key:    key,
+	}
+	d.uploads = append(d.uploads, u)
+	return u
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	u.buf = append(u.buf, p...)
+	if len(u.buf) >= int(u.d.s3PartSize) {
+		if err := u.uploadPart(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close uploads the rest of the output as the last part. An empty output is
+// not uploaded until the upload is completed.
+func (u *s3Upload) Close() error {
+	if len(u.buf) > 0 {
+		if err := u.uploadPart(); err != nil {
+			return err
+		}
+	}
+	u.buf = nil
+	return nil
+}
+
+func (u *s3Upload) uploadPart() error {
+	ctx := context.Background()
+	if u.uploadID == "" {
+		id, err := u.d.s3.NewMultipartUpload(ctx, u.bucket, u.key, minio.PutObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("starting upload of %s: %w", u.path, err)
+		}
+		u.uploadID = id
+	}
+	n := len(u.parts) + 1
+	if n > s3MaxParts {
+		return fmt.Errorf("upload of %s has more than %d parts, raise --s3-part-size", u.path, s3MaxParts)
+	}
+
+	for attempt := 0; ; attempt++ {
+		part, err := u.d.s3.PutObjectPart(ctx, u.bucket, u.key, u.uploadID, n,
+			bytes.NewReader(u.buf), int64(len(u.buf)), minio.PutObjectPartOptions{})
+		if err == nil {
+			u.parts = append(u.parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+			break
+		}
+		if !isRetryableS3Error(err) || attempt >= u.d.retries {
+			return fmt.Errorf("uploading part %d of %s: %w", n, u.path, err)
+		}
+		delay := u.d.retryBackoff(attempt)
+		atomic.AddUint64(&u.d.retried, 1)
+		log.Warn("uploading part failed, retrying", "file", u.path, "part", n, "err", err,
+			"attempt", fmt.Sprintf("%d/%d", attempt+1, u.d.retries), "backoff", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+	log.Debug("uploaded part", "file", u.path, "part", n, "size", len(u.buf))
+	u.size += int64(len(u.buf))
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// isRetryableS3Error returns whether the upload of a part failed for a
+// transient reason, i.e. anything but a client error such as missing
+// permissions or bucket.
+func isRetryableS3Error(err error) bool {
+	status := minio.ToErrorResponse(err).StatusCode
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// complete makes the uploaded object visible.
+func (u *s3Upload) complete(ctx context.Context) error {
+	if u.uploadID == "" {
+		_, err := u.d.s3.PutObject(ctx, u.bucket, u.key, bytes.NewReader(nil), 0, "", "", minio.PutObjectOptions{})
+		return err
+	}
+	_, err := u.d.s3.CompleteMultipartUpload(ctx, u.bucket, u.key, u.uploadID, u.parts, minio.PutObjectOptions{})
+	return err
+}
+
+// completeUploads completes the uploads to S3 if the dump succeeded, or
+// aborts them so that the uploaded parts are deleted.
+func (d *dumper) completeUploads(success bool) error {
+	ctx := context.Background()
+	var firstErr error
+	for _, u := range d.uploads {
+		if !success {
+			if u.uploadID == "" {
+				continue
+			}
+			if err := d.s3.AbortMultipartUpload(ctx, u.bucket, u.key, u.uploadID); err != nil {
+				log.Error("aborting upload", "file", u.path, "err", err)
+			}
+			continue
+		}
+		if err := u.complete(ctx); err != nil {
+			log.Error("completing upload", "file", u.path, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		log.Info("uploaded", "file", u.path, "size", u.size)
+	}
+	if !success && len(d.uploads) > 0 {
+		log.Warn("dump incomplete, the uploads to S3 have been aborted")
+	}
+	return firstErr
+}
+
+// finishUploads uploads the last part of the output, and completes the uploads
+// if the dump succeeded, i.e. if it returned no error or was following new
+// documents until interrupted.
+func (d *dumper) finishUploads(err error) error {
+	success := err == nil || (errors.Is(err, context.Canceled) && d.follow)
+	if success && d.outFile != nil {
+		if err := d.outFile.Close(); err != nil {
+			log.Error("closing output file", "err", err)
+			d.completeUploads(false)
+			return err
+		}
+	}
+	// the output must not be closed again, nor its last part uploaded if the
+	// dump failed
+	d.outFile = nil
+	if uploadErr := d.completeUploads(success); uploadErr != nil && err == nil {
+		err = uploadErr
+	}
+	return err
+}
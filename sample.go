@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+
+	"github.com/charmbracelet/log"
+)
+
+// needsClientSample returns whether the sample cannot be done by the server
+// with a random score and min_score, because the query supplied on stdin
+// already relies on the scores of the documents.
+func needsClientSample(q obj, random bool) bool {
+	if _, ok := q["min_score"]; ok {
+		log.Warn("the query already has a min_score, sampling on the client side")
+		return true
+	}
+	for _, field := range sortFields(q["sort"]) {
+		if field == "_score" && !random {
+			log.Warn("the query is sorted by score, sampling on the client side")
+			return true
+		}
+	}
+	return false
+}
+
+// sampled returns whether the hit is kept in the sample, with a probability of
+// the sample fraction. With a seed, the decision only depends on the seed and
+// the hit, so that the same hits are kept on each run.
+func (d *dumper) sampled(h hit) bool {
+	if d.seeded {
+		return d.hitHash(h) < d.sample
+	}
+	return rand.Float64() < d.sample
+}
+
+// hitHash returns a hash of the seed and the index and id of the hit,
+// uniformly distributed in [0, 1).
+func (d *dumper) hitHash(h hit) float64 {
+	hash := fnv.New64a()
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], uint64(d.seed))
+	hash.Write(seed[:])
+	hash.Write([]byte(h.index))
+	// the index and id can't contain a NUL byte
+	hash.Write([]byte{0})
+	hash.Write([]byte(h.id))
+	// the high bits of FNV barely change with the last bytes, e.g. between
+	// sequential ids, they are mixed with the finalizer of MurmurHash3
+	x := hash.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x>>11) / (1 << 53)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestSampled(t *testing.T) {
+	d := dumper{sample: 0.1, seeded: true, seed: 3}
+	var kept int
+	for i := 0; i < 10000; i++ {
+		h := hit{index: "i", id: fmt.Sprint(i), doc: json.RawMessage(`{"a":1}`)}
+		in := d.sampled(h)
+		if in {
+			kept++
+		}
+		// the sample doesn't depend on the fields output
+		h.doc = json.RawMessage(`{"_index":"i","_id":"` + h.id + `"}`)
+		if d.sampled(h) != in {
+			t.Fatalf("hit %s is sampled depending on its document", h.id)
+		}
+	}
+	if kept < 900 || kept > 1100 {
+		t.Errorf("kept %d hits of sequential ids out of 10000, want about 1000", kept)
+	}
+}
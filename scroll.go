@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,23 +15,98 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func scroll(ctx context.Context, scrollers []func(context.Context) error) error {
+// scroll runs the scrollers, at most maxConcurrency at the same time if set.
+// The others are queued until a running scroller completes.
+func (d *dumper) scroll(ctx context.Context, scrollers []func(context.Context) error) error {
 	grp, ctx := errgroup.WithContext(ctx)
+	if d.maxConcurrency > 0 {
+		grp.SetLimit(d.maxConcurrency)
+	}
+	if d.merger != nil {
+		grp.Go(func() error {
+			return d.merger.run(ctx, d.outputPage)
+		})
+	}
+	atomic.StoreInt64(&d.queuedSlices, int64(len(scrollers)))
 	for _, scroller := range scrollers {
 		scroller := scroller
+		// blocks until there's a free spot
 		grp.Go(func() error {
+			atomic.AddInt64(&d.queuedSlices, -1)
 			return scroller(ctx)
 		})
+		if ctx.Err() != nil {
+			// a scroller failed, don't start the queued ones
+			break
+		}
 	}
 	return grp.Wait()
 }
 
-func (d *dumper) scrollSlice(ctx context.Context, index string, sliceIdx, sliceTotal int) error {
-	q := d.scrollQuery(sliceIdx, sliceTotal)
+// slice is a part of the dump that is fetched sequentially by a single
+// scroller: a slice of an index, a slice of the whole point-in-time with
+// --pit, or a partition of the range of a field.
+type slice struct {
+	key string
+	// index target to search, unused with --pit as the PIT defines it
+	index string
+	// sliced scroll, if max > 1
+	id  int
+	max int
+	// additional filter, if set
+	filter obj
+	// search preference, to restrict the slice to a shard
+	preference string
+}
+
+// sliceQuery returns a copy of the query restricted to the slice.
+func (d *dumper) sliceQuery(s slice) obj {
+	q := make(obj)
+	for k := range d.query {
+		q[k] = d.query[k]
+	}
+	if s.max > 1 {
+		q["slice"] = obj{
+			"id":  s.id,
+			"max": s.max,
+		}
+	}
+	if s.filter != nil {
+		// the original query must stay in a scoring context, it may be a
+		// random score
+		q["query"] = obj{
+			"bool": obj{
+				"must":   q["query"],
+				"filter": s.filter,
+			},
+		}
+	}
+	return q
+}
+
+func (d *dumper) scrollSlice(ctx context.Context, s slice) error {
+	ps := &pageSize{n: d.size}
+	// position of the last hit sent, to be able to resume the slice if the
+	// scroll context expires
+	pos := &scrollPosition{}
+
+	path := s.index + "/_search?scroll=" + d.scrollTimeoutES
+	if s.preference != "" {
+		path += "&preference=" + url.QueryEscape(s.preference)
+	}
 
 	reqStart := time.Now()
-	scrollID, totalHits, more, err := d.scrollRequest(ctx, index+"/_search?scroll="+d.scrollTimeoutES, q)
-	d.totalHitsCtr.Report(totalHits)
+	resp, more, err := d.scrollRequest(ctx, s.key, path, ps, pos, func() string {
+		return d.scrollQuery(s, ps.n)
+	})
+	ps.frozen = true
+	var scrollID string
+	if resp != nil {
+		scrollID = resp.GetScrollID()
+		d.totalHitsCtr.Report(resp.GetTotal())
+	} else {
+		d.totalHitsCtr.Report(0)
+	}
 	defer func() {
 		d.clearScrollContext(scrollID)
 	}()
@@ -48,34 +124,166 @@ func (d *dumper) scrollSlice(ctx context.Context, index string, sliceIdx, sliceT
 		if err != nil {
 			return fmt.Errorf("marshaling scroll request: %w", err)
 		}
-		q = string(qBytes)
+		q := string(qBytes)
 		reqStart = time.Now()
 		// do not immediately overwrite the scrollID, in case of error
 		// we want to clear the previous one
-		newScrollID, _, more, err := d.scrollRequest(ctx, "_search/scroll", q)
+		resp, more, err := d.scrollRequest(ctx, s.key, "_search/scroll", ps, pos, func() string {
+			return q
+		})
+		if isSearchContextMissing(err) {
+			// there's nothing left to clear
+			scrollID = ""
+			return d.resumeExpiredSlice(ctx, s, ps.n, pos)
+		}
 		if err != nil {
 			return err
 		}
-		scrollID = newScrollID
+		scrollID = resp.GetScrollID()
 		if !more {
 			return nil
 		}
 	}
 }
 
-// sendHits sends hits to the output and returns whether the count limit has been reached.
-func (d *dumper) sendHits(hits []json.RawMessage) bool {
-	scrolled := atomic.LoadUint64(&d.scrolled)
-	if d.count > 0 && scrolled >= d.count {
+// resumeExpiredSlice continues a slice whose scroll context has expired, from
+// after the last hit sent. As search_after cannot be used with scroll, nor
+// slicing without a scroll, the rest of the slice is fetched through a
+// point-in-time over its index.
+func (d *dumper) resumeExpiredSlice(ctx context.Context, s slice, size int, pos *scrollPosition) error {
+	if pos.sort == nil || hasPositionalSort(d.query["sort"]) {
+		return fmt.Errorf("scroll context of slice %s expired, increase --scroll-timeout; "+
+			"to be able to resume automatically, sort on fields with unique values "+
+			"(e.g. {\"sort\": [\"date\", \"id\"]} on stdin)", s.key)
+	}
+	if err := d.server.checkPIT(); err != nil {
+		return fmt.Errorf("scroll context of slice %s expired, increase --scroll-timeout; "+
+			"unable to resume automatically: %w", s.key, err)
+	}
+	if s.preference != "" {
+		return fmt.Errorf("scroll context of slice %s expired, increase --scroll-timeout; "+
+			"a slice restricted to a shard cannot be resumed", s.key)
+	}
+
+	log.Warn("scroll context expired, resuming slice with a point-in-time", "slice", s.key)
+	pitID, err := d.openPIT(ctx, s.index)
+	if err != nil {
+		return err
+	}
+	defer d.closePIT(pitID)
+
+	q := d.sliceQuery(s)
+	q["search_after"] = pos.sort
+	ps := &pageSize{n: size}
+	// the total hits of the slice have already been reported
+	return d.pitPages(ctx, s.key, ps, q, pitID, func(uint64) {})
+}
+
+// scrollPosition is the position of a scroll after the hits it has sent: the
+// sort values of the last one, and the hits sent with these same values, as
+// they may not be unique.
+type scrollPosition struct {
+	sort json.RawMessage
+	ids  map[string]bool
+}
+
+// next skips the hits that have already been sent from the position, which
+// are found again when resuming from it, and moves the position after the
+// others.
+func (p *scrollPosition) next(hits []hit) []hit {
+	if p.sort != nil {
+		kept := hits[:0]
+		for _, h := range hits {
+			if !bytes.Equal(h.sort, p.sort) || !p.ids[h.index+"/"+h.id] {
+				kept = append(kept, h)
+			}
+		}
+		hits = kept
+	}
+	if len(hits) == 0 {
+		return hits
+	}
+
+	last := hits[len(hits)-1].sort
+	if !bytes.Equal(last, p.sort) {
+		p.sort = last
+		p.ids = make(map[string]bool)
+	}
+	for i := len(hits) - 1; i >= 0 && bytes.Equal(hits[i].sort, last); i-- {
+		p.ids[hits[i].index+"/"+hits[i].id] = true
+	}
+	return hits
+}
+
+// hit is a document to be written to the output, along with the name of the
+// index it comes from.
+type hit struct {
+	index string
+	doc   json.RawMessage
+	// _id and sort values of the hit, to know where a scroll is
+	id   string
+	sort json.RawMessage
+	// doc values, requested to get the stratum of the hit
+	fields json.RawMessage
+}
+
+// page is a batch of hits fetched by a slice in a single request. Pages of a
+// given slice are sent to the writer in order, so that the writer always
+// knows up to where each slice has been written.
+type page struct {
+	slice string
+	hits  []hit
+	// sort values of the last hit of the page, to resume with search_after
+	searchAfter json.RawMessage
+	// last page of the slice
+	done bool
+}
+
+// sendPage sends a page to the output, through the merger of a seeded random
+// dump if any, and returns whether the count limit has been reached.
+func (d *dumper) sendPage(p page) bool {
+	if d.merger != nil {
+		return d.merger.add(p)
+	}
+	return d.outputPage(p)
+}
+
+func (d *dumper) outputPage(p page) bool {
+	if d.countReached() {
 		return true
 	}
 
-	for _, hit := range hits {
-		d.scrolledCh <- hit
+	if d.incrState != nil && d.incrState.toIDs != nil {
+		p.hits = d.incrementalHits(p.hits)
+	}
+	var stratified bool
+	if d.strata != nil {
+		p.hits, stratified = d.stratifyHits(p.hits)
+	}
+	if d.stripFields {
+		for i := range p.hits {
+			p.hits[i].doc = withoutFields(p.hits[i].doc)
+		}
 	}
 
-	scrolled = atomic.AddUint64(&d.scrolled, uint64(len(hits)))
-	return d.count > 0 && scrolled >= d.count
+	d.scrolledCh <- p
+
+	atomic.AddUint64(&d.scrolled, uint64(len(p.hits)))
+	return stratified || d.countReached()
+}
+
+// countReached returns whether the count limit has been reached. With a
+// client-side sample, the hits are sampled by the writer, so only those it has
+// written count.
+func (d *dumper) countReached() bool {
+	if d.count == 0 {
+		return false
+	}
+	counted := &d.scrolled
+	if d.clientSample {
+		counted = &d.dumped
+	}
+	return atomic.LoadUint64(counted) >= d.count
 }
 
 func (d *dumper) clearScrollContext(scrollID string) {
@@ -87,7 +295,15 @@ func (d *dumper) clearScrollContext(scrollID string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	status, raw, err := d.cl.Delete(ctx, "_search/scroll/"+scrollID, "", nil)
+	// the scroll ID is passed in the body rather than in the path, which is
+	// deprecated since Elasticsearch 7 but the body is supported by all
+	// versions and by OpenSearch
+	body, err := json.Marshal(map[string][]string{"scroll_id": {scrollID}})
+	if err != nil {
+		log.Error("clearing scroll context", "err", err)
+		return
+	}
+	status, raw, err := d.cl.Delete(ctx, "_search/scroll", string(body), nil)
 	if err != nil {
 		log.Error("clearing scroll context", "err", err)
 	}
@@ -111,30 +327,25 @@ func (d *dumper) throttlingDuration(reqDuration time.Duration) time.Duration {
 		return 0
 	}
 
+	if d.backpressure != nil && d.backpressure.delay() > reqDuration {
+		// when copying, slow down as much as the destination does
+		reqDuration = d.backpressure.delay()
+	}
 	delay := time.Duration(d.throttle * float32(reqDuration))
 
 	// make sure we don't sleep for more than the scroll context timeout, or
-	// even get too close to it, as we must avoid it expiring
+	// even get too close to it, as we must avoid it expiring (there is none
+	// when loading)
 	maxDelay := 3 * d.scrollTimeout / 4
-	if delay > maxDelay {
+	if d.scrollTimeout > 0 && delay > maxDelay {
 		delay = maxDelay
 	}
 	return delay
 }
 
-func (d *dumper) scrollQuery(sliceIdx, sliceTotal int) string {
-	q := d.query
-	if sliceTotal > 1 {
-		qCopy := make(obj)
-		for k := range d.query {
-			qCopy[k] = d.query[k]
-		}
-		qCopy["slice"] = obj{
-			"id":  sliceIdx,
-			"max": sliceTotal,
-		}
-		q = qCopy
-	}
+func (d *dumper) scrollQuery(s slice, size int) string {
+	q := d.sliceQuery(s)
+	q["size"] = size
 
 	b, err := json.Marshal(q)
 	if err != nil {
@@ -144,49 +355,94 @@ func (d *dumper) scrollQuery(sliceIdx, sliceTotal int) string {
 }
 
 type scrollResp interface {
-	GetHits() []json.RawMessage
+	GetHits() []hit
 	GetScrollID() string
+	GetPitID() string
+	GetLastSort() json.RawMessage
 	GetTotal() uint64
 }
 
 type scrollRespMetadata struct {
 	Hits struct {
-		Total struct {
-			Value uint64 `json:"value"`
-		} `json:"total"`
-		Hits []json.RawMessage `json:"hits"`
+		Total totalHits         `json:"total"`
+		Hits  []json.RawMessage `json:"hits"`
 	} `json:"hits"`
 	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id"`
 }
 
-func (r scrollRespMetadata) GetHits() []json.RawMessage {
-	return r.Hits.Hits
+func (r scrollRespMetadata) GetHits() []hit {
+	hits := make([]hit, len(r.Hits.Hits))
+	for i, raw := range r.Hits.Hits {
+		var meta struct {
+			Index  string          `json:"_index"`
+			ID     string          `json:"_id"`
+			Sort   json.RawMessage `json:"sort"`
+			Fields json.RawMessage `json:"fields"`
+		}
+		// the hit has been parsed already, it can't fail
+		_ = json.Unmarshal(raw, &meta)
+		hits[i] = hit{
+			index:  meta.Index,
+			doc:    raw,
+			id:     meta.ID,
+			sort:   meta.Sort,
+			fields: meta.Fields,
+		}
+	}
+	return hits
 }
 
 func (r scrollRespMetadata) GetScrollID() string {
 	return r.ScrollID
 }
 
+func (r scrollRespMetadata) GetPitID() string {
+	return r.PitID
+}
+
+func (r scrollRespMetadata) GetLastSort() json.RawMessage {
+	if len(r.Hits.Hits) == 0 {
+		return nil
+	}
+	var last struct {
+		Sort json.RawMessage `json:"sort"`
+	}
+	if err := json.Unmarshal(r.Hits.Hits[len(r.Hits.Hits)-1], &last); err != nil {
+		return nil
+	}
+	return last.Sort
+}
+
 func (r scrollRespMetadata) GetTotal() uint64 {
-	return r.Hits.Total.Value
+	return uint64(r.Hits.Total)
 }
 
 type scrollRespSourceOnly struct {
 	Hits struct {
-		Total struct {
-			Value uint64 `json:"value"`
-		} `json:"total"`
-		Hits []struct {
+		Total totalHits `json:"total"`
+		Hits  []struct {
+			Index  string          `json:"_index"`
+			ID     string          `json:"_id"`
 			Source json.RawMessage `json:"_source"`
+			Sort   json.RawMessage `json:"sort"`
+			Fields json.RawMessage `json:"fields"`
 		} `json:"hits"`
 	} `json:"hits"`
 	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id"`
 }
 
-func (r scrollRespSourceOnly) GetHits() []json.RawMessage {
-	hits := make([]json.RawMessage, len(r.Hits.Hits))
-	for i, hit := range r.Hits.Hits {
-		hits[i] = hit.Source
+func (r scrollRespSourceOnly) GetHits() []hit {
+	hits := make([]hit, len(r.Hits.Hits))
+	for i, h := range r.Hits.Hits {
+		hits[i] = hit{
+			index:  h.Index,
+			doc:    h.Source,
+			id:     h.ID,
+			sort:   h.Sort,
+			fields: h.Fields,
+		}
 	}
 	return hits
 }
@@ -195,42 +451,59 @@ func (r scrollRespSourceOnly) GetScrollID() string {
 	return r.ScrollID
 }
 
+func (r scrollRespSourceOnly) GetPitID() string {
+	return r.PitID
+}
+
+func (r scrollRespSourceOnly) GetLastSort() json.RawMessage {
+	if len(r.Hits.Hits) == 0 {
+		return nil
+	}
+	return r.Hits.Hits[len(r.Hits.Hits)-1].Sort
+}
+
 func (r scrollRespSourceOnly) GetTotal() uint64 {
-	return r.Hits.Total.Value
+	return uint64(r.Hits.Total)
 }
 
-func (d *dumper) scrollRequest(ctx context.Context, path, query string) (string, uint64, bool, error) {
+// scrollRequest sends a search or scroll request, sends the hits to the
+// output, and returns the response along with whether there are more hits to
+// fetch. The position, if set, skips the hits already sent and is moved after
+// the others.
+func (d *dumper) scrollRequest(ctx context.Context, sliceKey, path string, ps *pageSize, pos *scrollPosition, query func() string) (scrollResp, bool, error) {
 	var resp scrollResp
-	if d.metadata || d.metadataOnly {
+	if d.metadata || d.metadataOnly || d.fetchMetadata {
 		resp = &scrollRespMetadata{}
 	} else {
 		resp = &scrollRespSourceOnly{}
 	}
 
-	status, raw, err := d.cl.Get(ctx, path, query, resp)
+	err := d.searchWithRetry(ctx, sliceKey, path, ps, query, resp)
 	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			log.Error("sending scroll request", "err", err)
-		}
-		return "", 0, false, err
-	}
-
-	if status != http.StatusOK {
-		log.Error("got unexpected status code", "code", status, "response", string(raw))
-		return "", 0, false, errors.New("unexpected status code")
+		return nil, false, err
 	}
 
 	hits := resp.GetHits()
-	limitReached := d.sendHits(hits)
-	return resp.GetScrollID(), resp.GetTotal(), len(hits) == d.size && !limitReached, err
+	more := len(hits) == ps.n
+	if pos != nil {
+		hits = pos.next(hits)
+	}
+	limitReached := d.sendPage(page{
+		slice:       sliceKey,
+		hits:        hits,
+		searchAfter: resp.GetLastSort(),
+		done:        !more,
+	})
+	return resp, more && !limitReached, nil
 }
 
 // GroupCounter is a counter that aggregates counts from a given number of
 // goroutines. Each goroutine must call Report() exactly once.
 type GroupCounter struct {
-	cnt     uint64
-	pending int
-	mu      sync.RWMutex
+	cnt      uint64
+	pending  int
+	reported int
+	mu       sync.RWMutex
 }
 
 func NewGroupCounter(n int) *GroupCounter {
@@ -246,12 +519,71 @@ func (gc *GroupCounter) Report(cnt uint64) {
 	if gc.pending < 0 {
 		panic("GroupCounter pending < 0")
 	}
+	gc.reported++
 	gc.cnt += cnt
 }
 
+// Add adds n goroutines to the group, each of which must then call Report().
+func (gc *GroupCounter) Add(n int) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.pending += n
+}
+
 // Get returns the current count and whether all goroutines have reported.
 func (gc *GroupCounter) Get() (uint64, bool) {
 	gc.mu.RLock()
 	defer gc.mu.RUnlock()
 	return gc.cnt, gc.pending == 0
 }
+
+// Partial returns the count so far and the number of goroutines that have
+// reported it.
+func (gc *GroupCounter) Partial() (uint64, int) {
+	gc.mu.RLock()
+	defer gc.mu.RUnlock()
+	return gc.cnt, gc.reported
+}
+
+// addDocValueField requests the doc values of a field along with the hits,
+// in epoch millis for a date. If the query didn't request any, they are
+// removed from the hits written with their metadata.
+func (d *dumper) addDocValueField(field string, isDate bool) {
+	var f any = field
+	if isDate {
+		f = obj{"field": field, "format": "epoch_millis"}
+	}
+	docValues, _ := d.query["docvalue_fields"].([]any)
+	if docValues == nil {
+		d.stripFields = d.metadata || d.metadataOnly
+	}
+	d.query["docvalue_fields"] = append(docValues, f)
+}
+
+// fieldValues returns the doc values of a field of a hit, in the same form as
+// the keys of an aggregation.
+func fieldValues(fields json.RawMessage, field string) []string {
+	v := json.Get(fields, field)
+	if v.LastError() != nil || v.Size() == 0 {
+		return nil
+	}
+	values := make([]string, v.Size())
+	for i := range values {
+		values[i] = v.Get(i).ToString()
+	}
+	return values
+}
+
+// withoutFields removes the fields from a hit with its metadata.
+func withoutFields(doc json.RawMessage) json.RawMessage {
+	var hitDoc map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &hitDoc); err != nil {
+		return doc
+	}
+	delete(hitDoc, "fields")
+	b, err := json.ConfigCompatibleWithStandardLibrary.Marshal(hitDoc)
+	if err != nil {
+		return doc
+	}
+	return b
+}
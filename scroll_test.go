@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func testHit(index, id, sort string) hit {
+	return hit{index: index, id: id, sort: json.RawMessage(sort)}
+}
+
+func hitIDs(hits []hit) []string {
+	ids := []string{}
+	for _, h := range hits {
+		ids = append(ids, h.index+"/"+h.id)
+	}
+	return ids
+}
+
+func TestScrollPositionNext(t *testing.T) {
+	var pos scrollPosition
+	// sequence numbers are only unique within a shard, the last two hits of
+	// the page have the same
+	got := pos.next([]hit{
+		testHit("i", "a", "[1]"),
+		testHit("i", "b", "[2]"),
+		testHit("i", "c", "[2]"),
+	})
+	if want := []string{"i/a", "i/b", "i/c"}; !reflect.DeepEqual(hitIDs(got), want) {
+		t.Fatalf("first page: got %v, want %v", hitIDs(got), want)
+	}
+
+	// resumed from [2] inclusively: b and c are found again, along with d from
+	// another shard that hadn't been sent
+	got = pos.next([]hit{
+		testHit("i", "c", "[2]"),
+		testHit("i", "d", "[2]"),
+		testHit("i", "b", "[2]"),
+		testHit("j", "b", "[2]"),
+		testHit("i", "e", "[3]"),
+	})
+	if want := []string{"i/d", "j/b", "i/e"}; !reflect.DeepEqual(hitIDs(got), want) {
+		t.Fatalf("resumed page: got %v, want %v", hitIDs(got), want)
+	}
+	if string(pos.sort) != "[3]" || len(pos.ids) != 1 || !pos.ids["i/e"] {
+		t.Fatalf("position: got %s %v, want [3] [i/e]", pos.sort, pos.ids)
+	}
+
+	// all the hits of the page have already been sent
+	pos.next([]hit{testHit("i", "f", "[3]")})
+	got = pos.next([]hit{testHit("i", "e", "[3]"), testHit("i", "f", "[3]")})
+	if len(got) != 0 {
+		t.Fatalf("page already sent: got %v, want none", hitIDs(got))
+	}
+	if len(pos.ids) != 2 {
+		t.Fatalf("position ids: got %v, want [i/e i/f]", pos.ids)
+	}
+}
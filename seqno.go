@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// seqNoField is the incremental field that enables the per-shard incremental
+// mode, as sequence numbers are only meaningful within a shard.
+const seqNoField = "_seq_no"
+
+// seqNoRange is the range of sequence numbers of a shard to dump, i.e. those
+// greater than From and less than or equal to To.
+type seqNoRange struct {
+	// greatest sequence number of the last complete dump, nil before the
+	// first one
+	From *int64 `json:"from,omitempty"`
+	// global checkpoint of the shard when a dump that has not completed yet
+	// started
+	To *int64 `json:"to,omitempty"`
+}
+
+type shardStatsResp struct {
+	Indices map[string]struct {
+		Shards map[string][]struct {
+			Routing struct {
+				Primary bool `json:"primary"`
+			} `json:"routing"`
+			SeqNo struct {
+				GlobalCheckpoint int64 `json:"global_checkpoint"`
+			} `json:"seq_no"`
+		} `json:"shards"`
+	} `json:"indices"`
+}
+
+// initSeqNoBounds sets the upper bound of each shard to its global checkpoint,
+// below which all the operations have been applied to all the shard copies,
+// unless a previous dump has not completed, in which case its bounds are kept.
+func (d *dumper) initSeqNoBounds(ctx context.Context, st *incrementalState) {
+	if st.Shards == nil {
+		st.Shards = make(map[string]*seqNoRange)
+	}
+	for _, r := range st.Shards {
+		if r.To != nil {
+			log.Info("resuming the previous incremental dump, which didn't complete", "file", d.state)
+			return
+		}
+	}
+
+	var resp shardStatsResp
+	path := d.target + "/_stats?level=shards&filter_path=indices.*.shards.*.routing.primary,indices.*.shards.*.seq_no.global_checkpoint"
+	status, raw, err := d.cl.Get(ctx, path, "", &resp)
+	if err != nil {
+		log.Fatal("getting the sequence numbers of the shards", "err", err)
+	}
+	if status != http.StatusOK {
+		log.Fatal("getting the sequence numbers of the shards, got unexpected status code", "code", status, "response", string(raw))
+	}
+
+	for idxName, idx := range resp.Indices {
+		for shard, copies := range idx.Shards {
+			for _, c := range copies {
+				if !c.Routing.Primary {
+					continue
+				}
+				key := idxName + "/" + shard
+				r, ok := st.Shards[key]
+				if !ok {
+					r = &seqNoRange{}
+					st.Shards[key] = r
+				}
+				to := c.SeqNo.GlobalCheckpoint
+				if r.From != nil && *r.From > to {
+					// sequence numbers only go back if the index has been
+					// deleted and recreated
+					log.Warn("the sequence numbers of the shard went backwards, dumping it entirely", "shard", key,
+						"from", *r.From, "global_checkpoint", to)
+					r.From = nil
+				}
+				r.To = &to
+			}
+		}
+	}
+
+	// saved before dumping, so that a failed dump is retried with the same
+	// bounds
+	if err := st.save(); err != nil {
+		log.Fatal("saving state", "file", d.state, "err", err)
+	}
+}
+
+// seqNoSlices returns a slice for each shard that has changed since the last
+// dump, restricted to the shard with the preference parameter.
+func (d *dumper) seqNoSlices() []slice {
+	keys := make([]string, 0, len(d.incrState.Shards))
+	for key := range d.incrState.Shards {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var slices []slice
+	for _, key := range keys {
+		r := d.incrState.Shards[key]
+		if r.To == nil || *r.To < 0 || r.From != nil && *r.From >= *r.To {
+			continue
+		}
+		idxName, shard, err := splitShardKey(key)
+		if err != nil {
+			log.Fatal("invalid shard in state", "file", d.state, "shard", key)
+		}
+
+		rng := obj{"lte": *r.To}
+		if r.From != nil {
+			rng["gt"] = *r.From
+		}
+		slices = append(slices, slice{
+			key:        key,
+			index:      idxName,
+			preference: fmt.Sprintf("_shards:%d", shard),
+			filter:     obj{"range": obj{seqNoField: rng}},
+		})
+	}
+	log.Info("dumping the changed shards", "shards", len(keys), "changed", len(slices))
+	return slices
+}
+
+// splitShardKey splits a key of the form index/shard.
+func splitShardKey(key string) (string, int, error) {
+	i := strings.LastIndexByte(key, '/')
+	if i < 0 {
+		return "", 0, fmt.Errorf("missing shard number in %q", key)
+	}
+	shard, err := strconv.Atoi(key[i+1:])
+	return key[:i], shard, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag of a size in bytes, with an optional unit.
+type byteSize int64
+
+// String formats the size with the largest unit that divides it, e.g. 64MB.
+func (b *byteSize) String() string {
+	n := int64(*b)
+	if n == 0 {
+		return "0"
+	}
+	for i := 4; i > 0; i-- {
+		if mult := int64(1) << (10 * i); n%mult == 0 {
+			return strconv.FormatInt(n/mult, 10) + string("KMGT"[i-1]) + "B"
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func (b *byteSize) Type() string {
+	return "size"
+}
+
+// parseByteSize parses a size in bytes, with an optional unit (k, m, g or t,
+// in powers of 1024, optionally followed by b), e.g. 100mb.
+func parseByteSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	mult := int64(1)
+	for i, unit := range "kmgt" {
+		if strings.HasSuffix(str, string(unit)) {
+			str = str[:len(str)-1]
+			mult = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
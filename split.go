@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/log"
+)
+
+// extensions of the parts of the output, by format
+var formatExtensions = map[string]string{
+	formatJSONL:   ".jsonl",
+	formatCSV:     ".csv",
+	formatTSV:     ".tsv",
+	formatParquet: ".parquet",
+	formatBulk:    ".ndjson",
+}
+
+func (d *dumper) partPath(n int) string {
+	name := fmt.Sprintf("part-%05d%s", n, formatExtensions[d.format])
+	return d.compressedPath(joinOutputPath(d.outputDir, name))
+}
+
+// partFull returns whether the current part of the output has reached the
+// size limits, so that the next hit must be written to a new part.
+func (d *dumper) partFull() bool {
+	if d.outputDir == "" || d.partDocs == 0 {
+		return false
+	}
+	if d.splitDocs > 0 && d.partDocs >= d.splitDocs {
+		return true
+	}
+	// the compressor buffers large blocks, so the compressed size is only
+	// known long after the documents have been written
+	counter := d.outCounter
+	if d.rawCounter != nil {
+		counter = d.rawCounter
+	}
+	size := counter.n + int64(d.out.Buffered())
+	return d.splitBytes > 0 && size >= int64(d.splitBytes)
+}
+
+// nextPart completes the current part of the output and opens the next one.
+func (d *dumper) nextPart() error {
+	if err := d.finishOutput(); err != nil {
+		return err
+	}
+	if err := d.outFile.Close(); err != nil {
+		return err
+	}
+	d.part++
+	d.partDocs = 0
+	path := d.partPath(d.part)
+	f, err := d.createOutputFile(path)
+	if err != nil {
+		return err
+	}
+	log.Debug("writing the next part", "file", path)
+	d.setOutputFile(f, 0)
+
+	enc, err := d.newEncoder(d.out, true)
+	if err != nil {
+		return err
+	}
+	d.enc = enc
+	return nil
+}
+
+// removePartsAfter removes the parts of the output after the nth, which are
+// left over from an interrupted dump and will be written again.
+func (d *dumper) removePartsAfter(n int) {
+	for i := n + 1; ; i++ {
+		err := os.Remove(d.partPath(i))
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if err != nil {
+			log.Fatal("removing output part", "err", err)
+		}
+	}
+}
+
+// logOutputFiles logs the list of the files of the output, when there are
+// several.
+func (d *dumper) logOutputFiles() {
+	if d.archive != "" {
+		// the files are in the archive, which is logged once written
+		return
+	}
+	if d.tmpl != nil {
+		d.tmpl.logFiles()
+		return
+	}
+	if d.outputDir == "" || isS3Path(d.outputDir) {
+		// the uploads are logged once completed
+		return
+	}
+	for i := 1; i <= d.part; i++ {
+		path := d.partPath(i)
+		st, err := os.Stat(path)
+		if err != nil {
+			log.Error("reading output part", "err", err)
+			continue
+		}
+		log.Info("output part", "file", path, "size", st.Size())
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+// maxStrata is the max number of strata, i.e. of terms aggregation buckets.
+const maxStrata = 10000
+
+// maxLoggedStrata is the max number of strata whose quotas are logged.
+const maxLoggedStrata = 100
+
+// missingStratum is the stratum of the documents that don't have a value for
+// the stratification field.
+const missingStratum = "\x00missing"
+
+// strata enforces a quota of hits per stratum, i.e. per index or per value of
+// a field.
+type strata struct {
+	mu     sync.Mutex
+	quotas map[string]uint64
+	counts map[string]uint64
+	// number of strata whose quota has been reached
+	full int
+}
+
+type strataResp struct {
+	Aggregations struct {
+		Strata struct {
+			SumOtherDocCount uint64 `json:"sum_other_doc_count"`
+			Buckets          []struct {
+				Key         json.RawMessage `json:"key"`
+				KeyAsString string          `json:"key_as_string"`
+				DocCount    uint64          `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"strata"`
+		Missing struct {
+			DocCount uint64 `json:"doc_count"`
+		} `json:"missing"`
+	} `json:"aggregations"`
+}
+
+// initStrata counts the documents of each stratum with a terms aggregation, and
+// computes the quota of each one: the total count is allocated in proportion
+// to the size of the strata, and then capped by the per-stratum count.
+//
+// The stratum of each hit is then read from the doc values of the field,
+// requested with docvalue_fields, which hold the same values as the terms
+// aggregation, unlike the _source.
+func (d *dumper) initStrata(ctx context.Context) {
+	aggs := obj{
+		"strata": obj{
+			"terms": obj{
+				"field": d.stratifyBy,
+				"size":  maxStrata,
+			},
+		},
+	}
+	if d.stratifyBy != "_index" {
+		aggs["missing"] = obj{
+			"missing": obj{
+				"field": d.stratifyBy,
+			},
+		}
+	}
+	req := obj{
+		"size":  0,
+		"query": d.query["query"],
+		"aggs":  aggs,
+	}
+	if minScore, ok := d.query["min_score"]; ok {
+		req["min_score"] = minScore
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Fatal("marshaling strata query", "err", err)
+	}
+
+	var resp strataResp
+	status, raw, err := d.cl.Get(ctx, d.target+"/_search", string(body), &resp)
+	if err != nil {
+		log.Fatal("counting the documents of each stratum", "err", err)
+	}
+	if status != http.StatusOK {
+		log.Fatal("counting the documents of each stratum, got unexpected status code", "code", status, "response", string(raw))
+	}
+	agg := resp.Aggregations.Strata
+	if agg.SumOtherDocCount > 0 {
+		log.Fatal("too many strata", "field", d.stratifyBy, "max", maxStrata)
+	}
+
+	// dates are matched on their epoch millis keys, as the format of the
+	// doc values may not be the one of key_as_string on older versions
+	var isDate bool
+	for _, b := range agg.Buckets {
+		if b.KeyAsString != "" && b.KeyAsString != "true" && b.KeyAsString != "false" {
+			isDate = true
+		}
+	}
+	sizes := make(map[string]uint64)
+	labels := make(map[string]string)
+	for _, b := range agg.Buckets {
+		key := b.KeyAsString
+		if key == "" || isDate {
+			key = json.Get(b.Key).ToString()
+		}
+		sizes[key] = b.DocCount
+		labels[key] = b.KeyAsString
+		if labels[key] == "" {
+			labels[key] = key
+		}
+	}
+	if missing := resp.Aggregations.Missing.DocCount; missing > 0 {
+		sizes[missingStratum] = missing
+		labels[missingStratum] = "(missing)"
+	}
+
+	quotas := allocateQuotas(sizes, d.count)
+	for key, q := range quotas {
+		if d.stratumCount > 0 && q > d.stratumCount {
+			quotas[key] = d.stratumCount
+		}
+	}
+
+	d.strata = &strata{
+		quotas: quotas,
+		counts: make(map[string]uint64),
+	}
+	if d.stratifyBy != "_index" {
+		d.addDocValueField(d.stratifyBy, isDate)
+	}
+	keys := make([]string, 0, len(quotas))
+	for key, q := range quotas {
+		if q == 0 {
+			d.strata.full++
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	log.Info("stratifying", "field", d.stratifyBy, "strata", len(quotas))
+	if len(keys) > maxLoggedStrata {
+		return
+	}
+	for _, key := range keys {
+		log.Info("stratum", "value", labels[key], "docs", sizes[key], "quota", quotas[key])
+	}
+}
+
+// allocateQuotas splits the total count between the strata in proportion to
+// their sizes, with the largest remainder method so that the quotas add up
+// exactly to the total. With no total count, the quota of each stratum is its
+// size.
+func allocateQuotas(sizes map[string]uint64, count uint64) map[string]uint64 {
+	var total uint64
+	for _, n := range sizes {
+		total += n
+	}
+	quotas := make(map[string]uint64, len(sizes))
+	if count == 0 || count >= total {
+		for key, n := range sizes {
+			quotas[key] = n
+		}
+		return quotas
+	}
+
+	type remainder struct {
+		key string
+		rem float64
+	}
+	var rems []remainder
+	var allocated uint64
+	for key, n := range sizes {
+		exact := float64(count) * float64(n) / float64(total)
+		q := math.Floor(exact)
+		quotas[key] = uint64(q)
+		allocated += uint64(q)
+		rems = append(rems, remainder{key, exact - q})
+	}
+	sort.Slice(rems, func(i, j int) bool {
+		if rems[i].rem != rems[j].rem {
+			return rems[i].rem > rems[j].rem
+		}
+		return rems[i].key < rems[j].key
+	})
+	for i := 0; allocated < count; i++ {
+		quotas[rems[i].key]++
+		allocated++
+	}
+	return quotas
+}
+
+// stratifyHits only keeps the hits whose stratum hasn't reached its quota yet,
+// and returns whether all the quotas have been reached.
+func (d *dumper) stratifyHits(hits []hit) ([]hit, bool) {
+	s := d.strata
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []hit
+	for _, h := range hits {
+		// a document with several values is counted in the bucket of each
+		// one by the terms aggregation, it takes the first one not full
+		key := ""
+		for _, k := range d.hitStrata(h) {
+			// the stratum may be unknown if the document was created after
+			// the strata were counted
+			if quota, ok := s.quotas[k]; ok && s.counts[k] < quota {
+				key = k
+				break
+			}
+		}
+		if key == "" {
+			continue
+		}
+		quota := s.quotas[key]
+		s.counts[key]++
+		if s.counts[key] == quota {
+			s.full++
+		}
+		kept = append(kept, h)
+	}
+	return kept, s.full == len(s.quotas)
+}
+
+// hitStrata returns the strata of the values of the hit, in the same form as
+// the keys of the terms aggregation.
+func (d *dumper) hitStrata(h hit) []string {
+	if d.stratifyBy == "_index" {
+		return []string{h.index}
+	}
+	keys := fieldValues(h.fields, d.stratifyBy)
+	if len(keys) == 0 {
+		return []string{missingStratum}
+	}
+	return keys
+}
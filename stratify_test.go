@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestStratifyHits(t *testing.T) {
+	d := dumper{
+		stratifyBy: "tags",
+		strata: &strata{
+			quotas: map[string]uint64{"x": 1, "y": 1, missingStratum: 1},
+			counts: make(map[string]uint64),
+		},
+	}
+	fieldsHit := func(id, fields string) hit {
+		return hit{index: "i", id: id, fields: json.RawMessage(fields)}
+	}
+	hits, full := d.stratifyHits([]hit{
+		fieldsHit("a", `{"tags":["x","y"]}`),
+		// x is full, the hit goes to y
+		fieldsHit("b", `{"tags":["x","y"]}`),
+		fieldsHit("c", `{"tags":["x"]}`),
+		// created after the strata were counted
+		fieldsHit("d", `{"tags":["z"]}`),
+		fieldsHit("e", ``),
+	})
+	if want := []string{"i/a", "i/b", "i/e"}; !reflect.DeepEqual(hitIDs(hits), want) {
+		t.Errorf("got %v, want %v", hitIDs(hits), want)
+	}
+	if !full {
+		t.Error("all the strata should be full")
+	}
+}
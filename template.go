@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// templateFile is the output file of an index, with its own buffer, compressor
+// and encoder.
+type templateFile struct {
+	path string
+	docs uint64
+
+	f       io.WriteCloser
+	out     *bufio.Writer
+	zw      compressor
+	enc     encoder
+	lastUse uint64
+
+	// bytes written to and by the compressor
+	rawCounter *countingWriter
+	outCounter *countingWriter
+}
+
+// templateEncoder writes the hits of each index to its own file, named after
+// the output template. The number of files open at the same time is limited:
+// the least recently used file is closed, and reopened in append mode when
+// needed again.
+type templateEncoder struct {
+	d       *dumper
+	files   map[string]*templateFile
+	open    int
+	maxOpen int
+	uses    uint64
+
+	// bytes written to and by the compressors of the closed files
+	rawBytes        int64
+	compressedBytes int64
+}
+
+func (d *dumper) newTemplateEncoder() *templateEncoder {
+	return &templateEncoder{
+		d:       d,
+		files:   make(map[string]*templateFile),
+		maxOpen: d.maxOpenFiles,
+	}
+}
+
+func (e *templateEncoder) encode(h hit) error {
+	tf, err := e.file(h.index)
+	if err != nil {
+		return err
+	}
+	if err := tf.enc.encode(h); err != nil {
+		return err
+	}
+	tf.docs++
+	return nil
+}
+
+// file returns the open file of the index.
+func (e *templateEncoder) file(index string) (*templateFile, error) {
+	e.uses++
+	tf, ok := e.files[index]
+	if !ok {
+		path := strings.ReplaceAll(e.d.outputTemplate, "{index}", index)
+		tf = &templateFile{path: e.d.compressedPath(path)}
+		e.files[index] = tf
+	}
+	tf.lastUse = e.uses
+	if tf.f != nil {
+		return tf, nil
+	}
+
+	if e.open >= e.maxOpen {
+		if err := e.closeLeastRecentlyUsed(); err != nil {
+			return nil, err
+		}
+	}
+	// the file is created by its first opening, and appended to after
+	reopen := tf.docs > 0
+	var f io.WriteCloser
+	var err error
+	if reopen {
+		f, err = os.OpenFile(tf.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	} else {
+		if !isS3Path(tf.path) {
+			if err := os.MkdirAll(filepath.Dir(tf.path), 0o755); err != nil {
+				return nil, err
+			}
+		}
+		f, err = e.d.createOutputFile(tf.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tf.f = f
+	if e.d.compress != "" {
+		// a reopened file gets a new gzip member or zstd frame
+		tf.outCounter = &countingWriter{w: f}
+		tf.zw = e.d.newCompressor(tf.outCounter)
+		tf.rawCounter = &countingWriter{w: tf.zw}
+		tf.out = bufio.NewWriter(tf.rawCounter)
+	} else {
+		tf.out = bufio.NewWriter(f)
+	}
+	tf.enc, err = e.d.newEncoder(tf.out, !reopen)
+	if err != nil {
+		return nil, err
+	}
+	e.open++
+	return tf, nil
+}
+
+func (e *templateEncoder) closeLeastRecentlyUsed() error {
+	var lru *templateFile
+	for _, tf := range e.files {
+		if tf.f != nil && (lru == nil || tf.lastUse < lru.lastUse) {
+			lru = tf
+		}
+	}
+	if e.d.format == formatParquet {
+		// a Parquet file is only complete once closed, and cannot be appended to
+		return fmt.Errorf("more than %d indices to write to Parquet files, raise --max-open-files", e.maxOpen)
+	}
+	if isS3Path(e.d.outputTemplate) {
+		// neither can an upload to S3
+		return fmt.Errorf("more than %d indices to upload to S3, raise --max-open-files", e.maxOpen)
+	}
+	return e.closeFile(lru)
+}
+
+func (e *templateEncoder) closeFile(tf *templateFile) error {
+	if err := tf.enc.close(); err != nil {
+		return err
+	}
+	if err := tf.out.Flush(); err != nil {
+		return err
+	}
+	if tf.zw != nil {
+		if err := tf.zw.Close(); err != nil {
+			return err
+		}
+		e.rawBytes += tf.rawCounter.total
+		e.compressedBytes += tf.outCounter.total
+	}
+	if err := tf.f.Close(); err != nil {
+		return err
+	}
+	tf.f, tf.out, tf.zw, tf.enc = nil, nil, nil, nil
+	tf.rawCounter, tf.outCounter = nil, nil
+	e.open--
+	return nil
+}
+
+func (e *templateEncoder) flush() error {
+	for _, tf := range e.files {
+		if tf.f == nil {
+			continue
+		}
+		if err := tf.enc.flush(); err != nil {
+			return err
+		}
+		if err := tf.out.Flush(); err != nil {
+			return err
+		}
+		if tf.zw != nil {
+			if err := tf.zw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *templateEncoder) close() error {
+	for _, tf := range e.files {
+		if tf.f == nil {
+			continue
+		}
+		if err := e.closeFile(tf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logFiles logs the list of the output files, with their number of documents.
+func (e *templateEncoder) logFiles() {
+	paths := make([]string, 0, len(e.files))
+	docs := make(map[string]uint64, len(e.files))
+	for _, tf := range e.files {
+		paths = append(paths, tf.path)
+		docs[tf.path] = tf.docs
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		log.Info("output file", "file", path, "docs", docs[path])
+	}
+}
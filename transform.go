@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+const (
+	transformRename = "rename"
+	transformMove   = "move"
+	transformDrop   = "drop"
+	transformSet    = "set"
+)
+
+// transformJSON writes the transformed documents with sorted keys, as the
+// order of the fields is lost when they are decoded.
+var transformJSON = json.Config{UseNumber: true, SortMapKeys: true}.Froze()
+
+// hitMetadataFields are the metadata fields of a hit that move can read or
+// write, next to its _source.
+var hitMetadataFields = map[string]bool{
+	"_index":        true,
+	"_type":         true,
+	"_id":           true,
+	"_routing":      true,
+	"_score":        true,
+	"_version":      true,
+	"_seq_no":       true,
+	"_primary_term": true,
+}
+
+// transform is a rule applied to each hit before it is written.
+type transform struct {
+	rule string
+	op   string
+	// the paths of the fields, split on dots; for drop, from is a pattern
+	from []string
+	to   []string
+	// the value of set
+	value any
+}
+
+// parseTransforms parses the transform rules, from the file and then from the
+// command line, and returns their errors.
+func (d *dumper) parseTransforms() []string {
+	rules := d.transformRules
+	if d.transformFile != "" {
+		data, err := os.ReadFile(d.transformFile)
+		if err != nil {
+			return []string{fmt.Sprintf("reading transform-file: %v", err)}
+		}
+		var fileRules []string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fileRules = append(fileRules, line)
+		}
+		rules = append(fileRules, rules...)
+	}
+
+	var errs []string
+	for _, rule := range rules {
+		t, err := parseTransform(rule)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid transform %q: %v", rule, err))
+			continue
+		}
+		if t.op == transformMove && !d.metadata && (t.isMetadata(t.from) || t.isMetadata(t.to)) {
+			// the hits must be fetched with their metadata, but only their
+			// _source is output
+			d.fetchMetadata = true
+		}
+		d.transforms = append(d.transforms, t)
+	}
+	return errs
+}
+
+func parseTransform(rule string) (transform, error) {
+	op, arg, _ := strings.Cut(strings.TrimSpace(rule), " ")
+	arg = strings.TrimSpace(arg)
+	t := transform{rule: rule, op: op}
+	if arg == "" {
+		return t, errors.New("missing argument")
+	}
+
+	switch op {
+	case transformDrop:
+		t.from = strings.Split(arg, ".")
+		for _, p := range t.from {
+			if _, err := path.Match(p, ""); p == "" || err != nil {
+				return t, fmt.Errorf("invalid pattern %q", arg)
+			}
+		}
+		return t, nil
+	case transformRename, transformMove, transformSet:
+	default:
+		return t, fmt.Errorf("unknown operation %q, must be one of rename, move, drop or set", op)
+	}
+
+	from, to, ok := strings.Cut(arg, "=")
+	if !ok && op == transformSet {
+		return t, errors.New("set requires field=value")
+	}
+	if !ok {
+		return t, fmt.Errorf("%s requires from=to", op)
+	}
+	var err error
+	if t.from, err = splitFieldPath(strings.TrimSpace(from)); err != nil {
+		return t, err
+	}
+	if op == transformSet {
+		if t.isMetadata(t.from) {
+			return t, errors.New("set only applies to the _source, use move to set the metadata fields")
+		}
+		// a value that is valid JSON (e.g. 42, true or {"a":1}) is taken as
+		// such, anything else as a string
+		value := strings.TrimSpace(to)
+		if err := transformJSON.UnmarshalFromString(value, &t.value); err != nil {
+			t.value = value
+		}
+		return t, nil
+	}
+	if t.to, err = splitFieldPath(strings.TrimSpace(to)); err != nil {
+		return t, err
+	}
+	if op == transformRename && (t.isMetadata(t.from) || t.isMetadata(t.to)) {
+		return t, errors.New("rename only applies to the _source, use move for the metadata fields")
+	}
+	return t, nil
+}
+
+func splitFieldPath(field string) ([]string, error) {
+	p := strings.Split(field, ".")
+	for _, s := range p {
+		if s == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+	}
+	return p, nil
+}
+
+// isMetadata returns whether the path is a metadata field of the hit, which
+// only move can read or write.
+func (t transform) isMetadata(p []string) bool {
+	return len(p) == 1 && hitMetadataFields[p[0]]
+}
+
+// apply applies the transform to the hit, whose metadata fields are only set
+// if they have been fetched, and its _source.
+func (t transform) apply(hitDoc, source obj) error {
+	switch t.op {
+	case transformDrop:
+		dropFields(source, t.from)
+		return nil
+	case transformSet:
+		return setField(source, t.from, t.value)
+	}
+
+	var value any
+	var found bool
+	if t.isMetadata(t.from) {
+		// the metadata of the hit is left as is, as the outputs that include
+		// it need it (e.g. _index and _id for the bulk format)
+		value, found = hitDoc[t.from[0]]
+	} else {
+		var err error
+		if value, found, err = removeField(source, t.from); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return nil
+	}
+	if t.isMetadata(t.to) {
+		switch v := value.(type) {
+		case string:
+			hitDoc[t.to[0]] = v
+		case fmt.Stringer:
+			// a number, e.g. a numeric id
+			hitDoc[t.to[0]] = v.String()
+		default:
+			return fmt.Errorf("%s must be a string or a number, got %T", t.to[0], value)
+		}
+		return nil
+	}
+	return setField(source, t.to, value)
+}
+
+// removeField removes the field and returns its value, if it exists.
+func removeField(doc obj, p []string) (any, bool, error) {
+	for i, key := range p[:len(p)-1] {
+		next, ok := doc[key]
+		if !ok {
+			return nil, false, nil
+		}
+		sub, ok := next.(map[string]any)
+		if !ok {
+			return nil, false, fmt.Errorf("%s is not an object", strings.Join(p[:i+1], "."))
+		}
+		doc = sub
+	}
+	value, ok := doc[p[len(p)-1]]
+	delete(doc, p[len(p)-1])
+	return value, ok, nil
+}
+
+// setField sets the field, creating the objects of its path.
+func setField(doc obj, p []string, value any) error {
+	for i, key := range p[:len(p)-1] {
+		next, ok := doc[key]
+		if !ok {
+			sub := make(map[string]any)
+			doc[key] = sub
+			doc = sub
+			continue
+		}
+		sub, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s is not an object", strings.Join(p[:i+1], "."))
+		}
+		doc = sub
+	}
+	doc[p[len(p)-1]] = value
+	return nil
+}
+
+// dropFields drops the fields that match the pattern, and the objects that are
+// left empty.
+func dropFields(doc obj, pattern []string) {
+	for key, value := range doc {
+		if ok, _ := path.Match(pattern[0], key); !ok {
+			continue
+		}
+		if len(pattern) == 1 {
+			delete(doc, key)
+			continue
+		}
+		if sub, ok := value.(map[string]any); ok && len(sub) > 0 {
+			dropFields(sub, pattern[1:])
+			if len(sub) == 0 {
+				delete(doc, key)
+			}
+		}
+	}
+}
+
+// transformHit applies the transforms to the hit. If one fails, the hit is
+// sent to the dead letter and false is returned.
+func (d *dumper) transformHit(h hit) (hit, bool, error) {
+	var hitDoc obj
+	err := transformJSON.Unmarshal(h.doc, &hitDoc)
+	source := hitDoc
+	if err == nil && (d.metadata || d.fetchMetadata) {
+		source, _ = hitDoc["_source"].(map[string]any)
+		if source == nil {
+			source = obj{}
+			hitDoc["_source"] = source
+		}
+	}
+	var rule string
+	for _, t := range d.transforms {
+		if err != nil {
+			break
+		}
+		rule = t.rule
+		err = t.apply(hitDoc, source)
+	}
+	if err != nil {
+		return h, false, d.deadLetterHit(h, rule, err)
+	}
+
+	out := hitDoc
+	if d.fetchMetadata {
+		out = source
+	}
+	if index, ok := hitDoc["_index"].(string); ok && (d.metadata || d.fetchMetadata) {
+		h.index = index
+	}
+	h.doc, err = transformJSON.Marshal(out)
+	if err != nil {
+		return h, false, d.deadLetterHit(h, rule, err)
+	}
+	return h, true, nil
+}
+
+type deadLetter struct {
+	Error string          `json:"error"`
+	Rule  string          `json:"rule,omitempty"`
+	Hit   json.RawMessage `json:"hit"`
+}
+
+// deadLetterHit writes the hit that failed to be transformed to the dead
+// letter, along with the error, or skips it if there is none.
+func (d *dumper) deadLetterHit(h hit, rule string, err error) error {
+	// only the first failure is logged, the others are counted
+	n := atomic.AddUint64(&d.transformFailed, 1)
+	if d.deadLetterOut == nil {
+		if n == 1 {
+			log.Warn("transform failed, skipping the documents (keep them with --dead-letter)", "rule", rule, "err", err)
+		}
+		return nil
+	}
+	if n == 1 {
+		log.Warn("transform failed, writing the documents to the dead letter", "file", d.deadLetter, "rule", rule, "err", err)
+	}
+	b, err := json.Marshal(deadLetter{Error: err.Error(), Rule: rule, Hit: h.doc})
+	if err != nil {
+		return err
+	}
+	if _, err := d.deadLetterOut.Write(b); err != nil {
+		return fmt.Errorf("writing dead letter: %w", err)
+	}
+	if err := d.deadLetterOut.WriteByte('\n'); err != nil {
+		return fmt.Errorf("writing dead letter: %w", err)
+	}
+	return nil
+}
+
+// openDeadLetter opens the dead letter. When resuming from a checkpoint, it is
+// truncated to its size at the checkpoint and appended to.
+func (d *dumper) openDeadLetter() {
+	if d.ckpt == nil {
+		f, err := d.createOutputFile(d.deadLetter)
+		if err != nil {
+			log.Fatal("opening dead letter", "err", err)
+		}
+		d.deadLetterFile = f
+		d.deadLetterOut = bufio.NewWriter(f)
+		return
+	}
+
+	f, err := os.OpenFile(d.deadLetter, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		log.Fatal("opening dead letter", "err", err)
+	}
+	offset := d.ckpt.DeadLetterOffset
+	if err := f.Truncate(offset); err != nil {
+		log.Fatal("truncating dead letter", "err", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Fatal("seeking dead letter", "err", err)
+	}
+	d.deadLetterFile = f
+	d.deadLetterOut = bufio.NewWriter(f)
+}
+
+// syncDeadLetter flushes the dead letter to disk and records its size in the
+// checkpoint.
+func (d *dumper) syncDeadLetter() error {
+	if err := d.deadLetterOut.Flush(); err != nil {
+		return err
+	}
+	// checkpoints are only allowed with a local dead letter
+	f := d.deadLetterFile.(*os.File)
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	d.ckpt.DeadLetterOffset = offset
+	return nil
+}
+
+func (d *dumper) closeDeadLetter() error {
+	var err error
+	if d.ckpt != nil {
+		// the last checkpoint is saved once the dead letter is closed
+		err = d.syncDeadLetter()
+	} else {
+		err = d.deadLetterOut.Flush()
+	}
+	if closeErr := d.deadLetterFile.Close(); err == nil {
+		err = closeErr
+	}
+	d.deadLetterFile, d.deadLetterOut = nil, nil
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	json "github.com/json-iterator/go"
+)
+
+const (
+	distElasticsearch = "elasticsearch"
+	distOpenSearch    = "opensearch"
+)
+
+// serverInfo is the distribution and version of the server, used to adapt the
+// requests to what it supports.
+type serverInfo struct {
+	distribution string
+	version      string
+	major        int
+	minor        int
+}
+
+type rootResp struct {
+	Version struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+	} `json:"version"`
+	Tagline string `json:"tagline"`
+}
+
+func (s serverInfo) String() string {
+	return s.distribution + " " + s.version
+}
+
+func (s serverInfo) atLeast(major, minor int) bool {
+	return s.major > major || s.major == major && s.minor >= minor
+}
+
+func (s serverInfo) isOpenSearch() bool {
+	return s.distribution == distOpenSearch
+}
+
+// checkPIT returns an error if the server doesn't support points-in-time.
+func (s serverInfo) checkPIT() error {
+	if s.isOpenSearch() {
+		if !s.atLeast(2, 4) {
+			return fmt.Errorf("point-in-time requires OpenSearch 2.4 or later, but server is %s", s)
+		}
+		return nil
+	}
+	if !s.atLeast(7, 10) {
+		return fmt.Errorf("point-in-time requires Elasticsearch 7.10 or later, but server is %s", s)
+	}
+	return nil
+}
+
+// supportsShardDoc returns whether the server supports the _shard_doc sort,
+// the point-in-time tiebreaker.
+func (s serverInfo) supportsShardDoc() bool {
+	return !s.isOpenSearch() && s.atLeast(7, 12)
+}
+
+// getServerInfo probes the root endpoint of the server to detect its
+// distribution and version.
+func (d *dumper) getServerInfo(ctx context.Context) serverInfo {
+	var resp rootResp
+	status, raw, err := d.cl.Get(ctx, "", "", &resp)
+	if err != nil {
+		log.Fatal("unable to get server info, are you sure the URL is correct?", "err", err)
+	}
+	if status != http.StatusOK {
+		// the user may not be allowed to access the root endpoint, assume a
+		// recent version
+		log.Warn("unable to detect server version, assuming a recent Elasticsearch", "code", status, "response", string(raw))
+		return serverInfo{distribution: distElasticsearch, version: "unknown", major: 8}
+	}
+
+	info := serverInfo{
+		distribution: distElasticsearch,
+		version:      resp.Version.Number,
+	}
+	if resp.Version.Distribution == distOpenSearch || strings.Contains(resp.Tagline, "OpenSearch") {
+		info.distribution = distOpenSearch
+	}
+
+	parts := strings.SplitN(resp.Version.Number, ".", 3)
+	if len(parts) >= 2 {
+		info.major, _ = strconv.Atoi(parts[0])
+		info.minor, _ = strconv.Atoi(parts[1])
+	}
+	if info.major == 0 {
+		log.Fatal("unable to parse server version", "version", resp.Version.Number)
+	}
+	if !info.isOpenSearch() && info.major < 6 {
+		log.Fatal("unsupported Elasticsearch version, 6.0 or later is required", "version", info.version)
+	}
+
+	log.Info("detected server", "distribution", info.distribution, "version", info.version)
+	return info
+}
+
+// totalHits is the total number of hits of a search response. It is an object
+// since Elasticsearch 7, but a plain integer before, and with the
+// rest_total_hits_as_int option.
+type totalHits uint64
+
+func (t *totalHits) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		var total struct {
+			Value uint64 `json:"value"`
+		}
+		if err := json.Unmarshal(b, &total); err != nil {
+			return err
+		}
+		*t = totalHits(total.Value)
+		return nil
+	}
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing total hits: %w", err)
+	}
+	*t = totalHits(v)
+	return nil
+}
@@ -1,50 +1,252 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"encoding/json"
+	"io"
+	"os"
 	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
 
+// openOutput opens the output file, or standard output if none is set. When
+// resuming from a checkpoint, the output file is truncated to what had been
+// written when the checkpoint was saved, and then appended to.
+func (d *dumper) openOutput() {
+	if d.outputTemplate != "" {
+		// the template encoder opens the files itself
+		d.tmpl = d.newTemplateEncoder()
+		d.enc = d.tmpl
+		return
+	}
+	if d.output == "" && d.outputDir == "" {
+		d.setOutput(os.Stdout, 0)
+		d.initEncoder(true)
+		return
+	}
+
+	path := d.output
+	switch {
+	case d.outputDir != "":
+		d.part = 1
+		if d.ckpt != nil && d.ckpt.OutputPart > 0 {
+			d.part = d.ckpt.OutputPart
+			d.partDocs = d.ckpt.PartDocs
+		}
+		if !isS3Path(d.outputDir) {
+			if err := os.MkdirAll(d.outputDir, 0o755); err != nil {
+				log.Fatal("creating output directory", "err", err)
+			}
+			d.removePartsAfter(d.part)
+		}
+		path = d.partPath(d.part)
+	case d.bulkChunkSize > 0:
+		d.chunks = 1
+		path = d.compressedPath(chunkPath(d.output, d.chunks))
+	default:
+		path = d.compressedPath(d.output)
+		if path != d.output {
+			log.Info("writing compressed output", "file", path)
+		}
+	}
+	if isS3Path(path) {
+		d.setOutputFile(d.newS3Upload(path), 0)
+		d.initEncoder(true)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		log.Fatal("opening output file", "err", err)
+	}
+	var offset int64
+	if d.ckpt != nil {
+		offset = d.ckpt.OutputOffset
+	}
+	if err := f.Truncate(offset); err != nil {
+		log.Fatal("truncating output file", "err", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Fatal("seeking output file", "err", err)
+	}
+	d.setOutputFile(f, offset)
+	d.initEncoder(offset == 0)
+}
+
+// createOutputFile creates a file of the output, or starts its upload to S3.
+func (d *dumper) createOutputFile(path string) (io.WriteCloser, error) {
+	if isS3Path(path) {
+		return d.newS3Upload(path), nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+}
+
+func (d *dumper) setOutputFile(f io.WriteCloser, offset int64) {
+	d.outFile = f
+	d.setOutput(f, offset)
+}
+
+// setOutput sets the writer of the output, which already has offset bytes,
+// through the compressor if the output is compressed.
+func (d *dumper) setOutput(w io.Writer, offset int64) {
+	if d.outCounter == nil {
+		d.outCounter = &countingWriter{}
+	}
+	d.outCounter.w = w
+	d.outCounter.n = offset
+
+	if d.compress == "" {
+		d.out = bufio.NewWriter(d.outCounter)
+		return
+	}
+	if d.zw == nil {
+		d.zw = d.newCompressor(d.outCounter)
+		d.rawCounter = &countingWriter{w: d.zw}
+	} else {
+		d.zw.Reset(d.outCounter)
+		d.rawCounter.n = 0
+	}
+	d.out = bufio.NewWriter(d.rawCounter)
+}
+
+// countingWriter counts the bytes written to the output: n in the current
+// file, to know the size of the current part, and total in all the files.
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	total int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.total += int64(n)
+	return n, err
+}
+
+func (d *dumper) initEncoder(header bool) {
+	enc, err := d.newEncoder(d.out, header)
+	if err != nil {
+		log.Fatal("writing output header", "err", err)
+	}
+	d.enc = enc
+}
+
+// flushOutput flushes the encoder, the output buffer and the compressor.
+func (d *dumper) flushOutput() error {
+	if err := d.enc.flush(); err != nil {
+		return err
+	}
+	if d.out == nil {
+		return nil
+	}
+	if err := d.out.Flush(); err != nil {
+		return err
+	}
+	if d.zw != nil {
+		return d.zw.Flush()
+	}
+	return nil
+}
+
+// finishOutput closes the encoder and the compressor, and flushes the output
+// buffer, at the end of the dump.
+func (d *dumper) finishOutput() error {
+	if err := d.enc.close(); err != nil {
+		return err
+	}
+	if d.out == nil {
+		return nil
+	}
+	if err := d.out.Flush(); err != nil {
+		return err
+	}
+	if d.zw != nil {
+		return d.zw.Close()
+	}
+	return nil
+}
+
+func (d *dumper) closeOutput() {
+	if d.outFile == nil {
+		return
+	}
+	if err := d.outFile.Close(); err != nil {
+		log.Error("closing output file", "err", err)
+	}
+	d.outFile = nil
+}
+
 func (d *dumper) write(ctx context.Context) error {
-	var buf bytes.Buffer
 	var stop bool
-	for hit := range d.scrolledCh {
+	for p := range d.scrolledCh {
 		if ctx.Err() != nil || stop {
 			continue
 		}
 
-		// Elasticsearch returns the document's _source exactly as it was
-		// indexed: if it was indexed with newlines, it will return newlines.
-		// But for the JSONL format, each hit must be on its own line.
-		// So we need to check if there are newlines, and remove them.
-		if bytes.IndexByte(hit, '\n') != -1 {
-			err := json.Compact(&buf, hit)
-			if err != nil {
-				log.Error("compacting hit into single-line JSON", "err", err)
+		written := 0
+		for _, h := range p.hits {
+			if d.clientSample && !d.sampled(h) {
+				// consumed, as far as the checkpoint is concerned
+				written++
+				continue
+			}
+			if d.transforms != nil {
+				var ok bool
+				var err error
+				if h, ok, err = d.transformHit(h); err != nil {
+					log.Error("writing to dead letter", "err", err)
+					return err
+				} else if !ok {
+					// consumed, as far as the checkpoint is concerned
+					written++
+					continue
+				}
+			}
+			if d.partFull() {
+				if err := d.nextPart(); err != nil {
+					log.Error("writing to output", "err", err)
+					return err
+				}
+			}
+			if err := d.enc.encode(h); err != nil {
+				log.Error("writing to output", "err", err)
 				return err
 			}
-			hit = buf.Bytes()
+			written++
+			d.partDocs++
+
+			dumped := atomic.AddUint64(&d.dumped, 1)
+			if d.count > 0 && dumped >= d.count {
+				stop = true
+				break
+			}
 		}
 
-		_, err := d.out.Write(hit)
-		if err != nil {
-			log.Error("writing to stdout", "err", err)
-			return err
+		if d.follow {
+			// the new documents must be output as soon as they are received
+			if err := d.flushOutput(); err != nil {
+				log.Error("writing to output", "err", err)
+				return err
+			}
 		}
-		err = d.out.WriteByte('\n')
-		if err != nil {
-			log.Error("writing to stdout", "err", err)
-			return err
+
+		if d.ckpt != nil {
+			d.ckpt.record(p, written)
+			if time.Since(d.ckpt.lastSave) >= checkpointInterval {
+				if err := d.saveCheckpoint(); err != nil {
+					log.Error("saving checkpoint", "err", err)
+					return err
+				}
+			}
 		}
-		buf.Reset()
+	}
 
-		dumped := atomic.AddUint64(&d.dumped, 1)
-		if d.count > 0 && dumped >= d.count {
-			stop = true
+	if d.ckpt != nil {
+		if err := d.saveCheckpoint(); err != nil {
+			log.Error("saving checkpoint", "err", err)
+			return err
 		}
 	}
 	return nil